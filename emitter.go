@@ -1,297 +1,4299 @@
 // Package emission provides an event emitter.
+//
+// The order in which the listeners of an event are called depends on how it
+// is emitted. Emit and EmitParallel call Go listeners concurrently, so their
+// order is unspecified, while otto listeners are called one after another in
+// the order they were added unless the Emitter has a pool of otto VMs (see
+// SetOttoVMPool). EmitSync, and Emit on a synchronous Emitter, call the
+// listeners in the order they were added, Go listeners before otto listeners.
+// EmitReverse calls them in exactly the reverse order.
 package emission
 
 import (
+	"container/list"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/robertkrimen/otto"
+	"io"
 	"os"
 	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Default number of maximum listeners for an event.
 const DefaultMaxListeners = 10
 
+// Default capacity of the channel returned by Errors.
+const DefaultErrorsBuffer = 64
+
+// Placeholder source of native otto listeners, which have no JavaScript
+// source, see OttoListenerSources.
+const NativeSource = "[native code]"
+
 // Error presented when an invalid argument is provided as a listener function
 var ErrNoneFunction = errors.New("Kind of Value for listener is not Func.")
 
-type RecoveryListener func(interface{}, interface{}, error)
+// Error presented when the argument received by a listener added with OnMap
+// is not a map.
+var ErrNoneMap = errors.New("Kind of Value for argument is not Map.")
+
+// Error presented when the first parameter of a listener added with
+// OnWithUnsub is not a func().
+var ErrNoneUnsubscribe = errors.New("Type of first parameter of listener is not func().")
+
+// Error presented when the first parameter of a listener added with
+// OnWithEmitter cannot be supplied the Emitter.
+var ErrNoneEmitter = errors.New("Type of first parameter of listener is not implemented by *Emitter.")
+
+// Error presented when the otto VM of an Emitter is replaced while its otto
+// listeners are being emitted to.
+var ErrOttoVMReplaced = errors.New("Emitter's otto VM was replaced during emit.")
+
+// Error presented when a listener is added to a closed Emitter.
+var ErrClosed = errors.New("Emitter is closed.")
+
+// Error presented when the listeners of an event emitted with EmitDeadline
+// have not all returned by the deadline.
+var ErrDeadlineExceeded = errors.New("Listeners did not return before the deadline.")
+
+// Error presented when an argument of an emit cannot be converted to an otto
+// Value for the otto listeners of the event.
+var ErrOttoConversion = errors.New("Argument cannot be converted for otto listeners.")
+
+// Error presented when an otto listener is added to, or emitted by, an
+// Emitter without an otto VM.
+var ErrNoOttoVM = errors.New("Emitter has no otto VM for otto listener.")
+
+// Error presented when a Future is not awaiting its event, as its listener
+// could not be added or was removed by a cancelled Get.
+var ErrNotAwaiting = errors.New("Future is not awaiting its event.")
+
+// CloseError is the error of CloseContext and CloseTimeout when listeners
+// are still running once they give up waiting.
+type CloseError struct {
+	// Events whose listeners were still running, ordered as by EventNames.
+	Events []interface{}
+	// Error of the context which was done.
+	Err error
+}
+
+func (err *CloseError) Error() string {
+	return fmt.Sprintf("Listeners of the events %v were still running when Close gave up waiting: %v", err.Events, err.Err)
+}
+
+// Unwrap returns the error of the context, so a CloseError can be matched
+// with errors.Is against context.DeadlineExceeded or context.Canceled.
+func (err *CloseError) Unwrap() error {
+	return err.Err
+}
+
+// Error presented when the error event, see SetErrorEvent, is emitted without
+// listeners and without an error as its first argument.
+var ErrUnhandledErrorEvent = errors.New("Error event emitted without listeners.")
+
+// Pool of argument slices shared by all Emitters to avoid allocating a new
+// slice of reflect Values on every call to Emit.
+var valuesPool = sync.Pool{
+	New: func() interface{} {
+		return new([]reflect.Value)
+	},
+}
+
+type RecoveryListener func(interface{}, interface{}, error)
+
+// ListenerError is the failure of a listener sent to the channel returned by
+// Errors.
+type ListenerError struct {
+	// Event the listener was added for, or emitted.
+	Event interface{}
+	// Listener which failed, as supplied to the RecoveryListener.
+	Listener interface{}
+	// Error of the listener, a recovered panic rendered as an error included.
+	Err error
+}
+
+// Tracer starts spans around emits and listener calls, so event propagation
+// shows up in distributed traces. See SetTracer.
+type Tracer interface {
+	// StartEmit is called when an emit is about to call the listeners of
+	// the event, returning the context carrying the emit's span and the
+	// function to call once every listener has returned.
+	StartEmit(ctx context.Context, event interface{}) (context.Context, func())
+	// StartListener is called before a listener of the event is called with
+	// the context returned by StartEmit and the listener's label (see
+	// Snapshot), returning the function to call once the listener returned.
+	StartListener(ctx context.Context, event interface{}, label string) func()
+}
+
+// Metrics records timings of emits, telling listeners being slow apart from
+// emits being held up before their listeners are called. See SetMetrics.
+type Metrics interface {
+	// QueueWait is called with the time an emit of the event waited before
+	// its listeners were called, either buffered by MuteBuffered until the
+	// event was unmuted or behind earlier emits of the event on an Emitter
+	// with SetSerialPerEvent, where every emit is reported. Other emits,
+	// which never wait, are not reported.
+	QueueWait(event interface{}, wait time.Duration)
+	// ListenerDuration is called with the time a listener of the event,
+	// with the label (see Snapshot), took to return.
+	ListenerDuration(event interface{}, label string, duration time.Duration)
+}
+
+// Invoker wraps the call of a listener of the event with the label (see
+// Snapshot), which it makes by calling next. See SetInvoker.
+type Invoker func(next func(), event interface{}, label string)
+
+// UnhandledHandler is called with the event and arguments of an emit which
+// found no listeners for the event.
+type UnhandledHandler func(interface{}, ...interface{})
+
+// RegistrationGuard approves the registration of a listener for an event by
+// returning nil, or refuses it by returning the error the registration fails
+// with, see SetRegistrationGuard.
+type RegistrationGuard func(event, listener interface{}) error
+
+// AnyListener is called with the event and arguments of every emit, see
+// OnAny.
+type AnyListener func(interface{}, ...interface{})
+
+// PanicFormatter renders the value recovered from a listener's panic as the
+// error supplied to the RecoveryListener.
+type PanicFormatter func(interface{}) error
+
+// listener is a Go or otto function added to an event of an Emitter.
+type listener struct {
+	// Reflect Value of a Go function, used to call functions of any
+	// signature and to find the listener for removal.
+	fn reflect.Value
+	// The function if it has the signature func(...interface{}), which
+	// is called directly instead of through the reflect package.
+	raw func(...interface{})
+	// Values supplied to the function before the emitted arguments.
+	prefix []reflect.Value
+	// Whether the first parameter of the function is a context.Context,
+	// which is supplied the context of the emit before any other value.
+	contextual bool
+	// Type of the parameter following the context, if any, when it is
+	// int64 or EmitMetadata, which is supplied the emit's sequence number
+	// by Emitters with SetEmitSequence.
+	sequenced reflect.Type
+	// Whether the last result of the function is an error, which is
+	// supplied to the RecoveryListener when it is not nil.
+	failing bool
+	// The function of an otto listener.
+	ottoFn otto.Value
+	// Group which was active when the listener was added, if any.
+	group *Group
+	// Label describing the listener, see Snapshot.
+	label string
+	// Label of the earlier listeners the listener is called after, see
+	// OnAfter.
+	after string
+	// Key identifying the listener for removal, see OnWithKey.
+	key interface{}
+	// Weight of the listener counted against the concurrency of its event,
+	// see OnWithWeight.
+	weight int
+	// Predicate deciding whether the listener is called for the arguments
+	// of an emit, a Go function or, for otto listeners, a JavaScript
+	// function, see OnIf.
+	filter     func(...interface{}) bool
+	ottoFilter otto.Value
+	// Id of the registration, unique within the Emitter.
+	id uint64
+	// Whether the listener is removed once emitted, see Once.
+	once bool
+}
+
+// newOttoListener returns a listener for an otto function, labelled with the
+// function's name.
+func newOttoListener(fn otto.Value) *listener {
+	label := "anonymous"
+
+	if name, err := fn.Object().Get("name"); nil == err && "" != name.String() {
+		label = name.String()
+	}
+
+	return &listener{ottoFn: fn, label: label, weight: 1}
+}
+
+// inherit gives the listener the attributes of the registration it replaces,
+// see ReplaceListener.
+func (listener *listener) inherit(old *listener) {
+	listener.id, listener.group, listener.key = old.id, old.group, old.key
+	listener.label, listener.after, listener.weight = old.label, old.after, old.weight
+	listener.once = old.once
+}
+
+// isOtto reports whether the listener is an otto listener.
+func (listener *listener) isOtto() bool {
+	return !listener.fn.IsValid()
+}
+
+// is reports whether the listener is a registration of fn, a Go function or
+// an otto function Value.
+func (listener *listener) is(fn interface{}) bool {
+	if ottoFn, ok := fn.(otto.Value); ok {
+		return listener.isOtto() && ottoFn == listener.ottoFn
+	}
+
+	return !listener.isOtto() && reflect.ValueOf(fn) == listener.fn
+}
+
+// Group is a handle on the listeners added to an Emitter while the group
+// was active, see BeginGroup.
+type Group struct{}
+
+// Type of the first parameter of listeners added with OnWithUnsub.
+var unsubscribeType = reflect.TypeOf(func() {})
+
+// Type of the Emitter supplied to listeners added with OnWithEmitter.
+var emitterType = reflect.TypeOf((*Emitter)(nil))
+
+// Type of the first parameter of listeners supplied the context of the emit.
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// Type of the last result of listeners whose errors are recovered.
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Types of the parameters of listeners supplied the sequence number of the
+// emit, see SetEmitSequence.
+var (
+	int64Type        = reflect.TypeOf(int64(0))
+	emitMetadataType = reflect.TypeOf(EmitMetadata{})
+)
+
+// newListener returns a listener for the reflect Value of a function,
+// labelled with the function's name.
+func newListener(fn reflect.Value) *listener {
+	raw, _ := fn.Interface().(func(...interface{}))
+	label := "unknown"
+
+	if f := runtime.FuncForPC(fn.Pointer()); nil != f {
+		label = f.Name()
+	}
+
+	typ := fn.Type()
+	contextual := nil == raw && 0 < typ.NumIn() && contextType == typ.In(0)
+	failing := 0 < typ.NumOut() && errorType == typ.Out(typ.NumOut()-1)
+
+	var sequenced reflect.Type
+
+	if i := 0; nil == raw {
+		if contextual {
+			i++
+		}
+
+		if i < typ.NumIn() && (int64Type == typ.In(i) || emitMetadataType == typ.In(i)) {
+			sequenced = typ.In(i)
+		}
+	}
+
+	return &listener{fn: fn, raw: raw, label: label, contextual: contextual, sequenced: sequenced, failing: failing, weight: 1}
+}
+
+// EventEmitter is the interface of the Emitter's methods for adding,
+// removing and emitting to listeners and for inspecting them, so code
+// depending on an emitter can be given a mock or another implementation.
+// The methods have the signatures of the Emitter's, those returning the
+// Emitter for chaining return an *Emitter. The interface is part of the
+// stable API: its methods are neither changed nor added to outside of a new
+// major version, as either would break its other implementations.
+type EventEmitter interface {
+	AddListener(event, listener interface{}) *Emitter
+	On(event, listener interface{}) *Emitter
+	Once(event, listener interface{}) *Emitter
+	RemoveListener(event, listener interface{}) *Emitter
+	Off(event, listener interface{}) *Emitter
+	Emit(event interface{}, arguments ...interface{}) *Emitter
+	ListenerCount(event interface{}) int
+	EventNames() []interface{}
+	MaxListeners() int
+	EventMaxListeners(event interface{}) int
+	HasOttoVM() bool
+	Snapshot() map[interface{}]EventSnapshot
+}
+
+// The Emitter must keep implementing EventEmitter.
+var _ EventEmitter = (*Emitter)(nil)
+
+type Emitter struct {
+	// Mutex to prevent race conditions within the Emitter.
+	*sync.Mutex
+	// Optional name identifying the Emitter in warnings and errors.
+	name string
+	// Map of event to a slice of listeners.
+	events     map[interface{}][]*listener
+	ottoEvents map[interface{}][]*listener
+	// Group tagging the listeners being added, if any.
+	group *Group
+	// Number of listener registrations, the id of the latest one.
+	registrations uint64
+	// Optional RecoveryListener to call when a panic occurs.
+	recoverer RecoveryListener
+	// Optional channel the failures of listeners are sent to, see Errors.
+	failures chan ListenerError
+	// Optional function rendering recovered panic values as errors.
+	panicFormatter PanicFormatter
+	// Optional function called when an event without listeners is emitted.
+	unhandled UnhandledHandler
+	// Optional function approving the registration of listeners.
+	guard RegistrationGuard
+	// Optional event failing when emitted without listeners, see
+	// SetErrorEvent.
+	errorEvent interface{}
+	// Listeners called for every event, see OnAny.
+	anyListeners []AnyListener
+	// Channels every emit is recorded to, see SinkTo.
+	sinks []sink
+	// Optional Tracer starting spans around emits and listener calls.
+	tracer Tracer
+	// Optional Metrics recording the timings of emits.
+	metrics Metrics
+	// Optional function wrapping every listener call, see SetInvoker.
+	invoker Invoker
+	// Maximum listeners for debugging potential memory leaks.
+	maxListeners int
+	// Writer of the warnings, stdout by default.
+	warnings io.Writer
+	// Map of event to its maximum listeners, overriding maxListeners.
+	eventMaxListeners map[interface{}]int
+	// Whether Emit calls listeners sequentially on the current go routine.
+	synchronous bool
+	// Whether every emitted event bubbles up to its ancestors.
+	bubbling bool
+	// Whether a single struct argument is referenced or dereferenced to
+	// match the parameter of each Go listener.
+	adaptPointers bool
+	// Whether arguments beyond the parameters of non-variadic Go listeners
+	// are dropped instead of making the call panic.
+	truncateArgs bool
+	// Whether a single struct argument is shared by the Go listeners
+	// through a pointer, see SetShareStructArgs.
+	shareStructArgs bool
+	// Whether emits are numbered, and the number of the last one, see
+	// SetEmitSequence.
+	sequencing bool
+	sequence   int64
+	// Map of event to the maximum number of its listeners called at once.
+	concurrency map[interface{}]int
+	// Whether the emits of each event are serialized, see
+	// SetSerialPerEvent, and the map of event to the semaphore held by its
+	// emit calling listeners.
+	serialPerEvent bool
+	serials        map[interface{}]chan struct{}
+	// Number of calls to Emit which have not returned yet, in total and by
+	// event.
+	inflight int
+	running  map[interface{}]int
+	// Condition signalled when no calls to Emit are in flight.
+	idle *sync.Cond
+	// Whether the Emitter has been closed.
+	closed bool
+	// Whether arguments which cannot be converted for otto listeners make
+	// the emit panic, see SetStrictOttoConversion.
+	strictOttoConversion bool
+	// Map of muted event to its mute, see Mute.
+	muted map[interface{}]*mute
+	// Map of event to the coalescer of its emits, see CoalesceOnTick.
+	coalescers map[interface{}]*coalescer
+	// Map of event to the time it was last emitted.
+	lastEmitted map[interface{}]time.Time
+	// Map of event to the number of emits whose arguments could not be
+	// converted for its otto listeners.
+	conversionErrors map[interface{}]uint64
+	// Map of event to the number of panics of its listeners recovered from.
+	panics map[interface{}]uint64
+	// Map of event to the number of records of its emits dropped by sinks.
+	sinkDrops map[interface{}]uint64
+	// Map of event to the number of failures of its listeners dropped by the
+	// channel returned by Errors.
+	errorDrops map[interface{}]uint64
+	//
+	ottoVM *otto.Otto
+	// Value of this for calls of otto listeners.
+	ottoThis otto.Value
+	// Optional pool of otto VMs calling otto listeners in parallel.
+	ottoPool *ottoPool
+	// Optional cache of the otto Values of arguments, see
+	// SetOttoValueCache.
+	ottoCache *ottoValueCache
+}
+
+// isListener reports whether listener can be called by an Emitter, that is
+// whether it is a Go function or an otto.Value holding a JavaScript function.
+func isListener(listener interface{}) bool {
+	if ottoFn, ok := listener.(otto.Value); ok {
+		return ottoFn.IsFunction()
+	}
+
+	return reflect.Func == reflect.ValueOf(listener).Kind()
+}
+
+// ValidateListener returns nil if the listener can be added to the Emitter,
+// being a Go function or an otto.Value holding a JavaScript function, else
+// the error AddListener fails with: ErrClosed once the Emitter is closed,
+// ErrNoneFunction for other values and ErrNoOttoVM for an otto listener of
+// an Emitter without an otto VM. It performs the checks made by AddListener,
+// except for the RegistrationGuard which depends on the event, without
+// adding the listener, for instance to give feedback on a pasted script
+// first.
+func (emitter *Emitter) ValidateListener(listener interface{}) error {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if err := emitter.check(listener); nil != err {
+		return namedError(emitter.name, err)
+	}
+
+	return nil
+}
+
+// AddListener appends the listener argument to the event arguments slice
+// in the Emitter's events map. If the number of listeners for an event
+// is greater than the Emitter's maximum listeners then a warning is printed.
+// If the relect Value of the listener does not have a Kind of Func, or the
+// listener is an otto.Value which is not a function, then AddListener panics
+// and the listener is never added, see AddListenerErr. Likewise AddListener
+// panics with ErrNoOttoVM when an otto listener is added to an Emitter
+// without an otto VM. If a RecoveryListener has been set then it is called
+// instead of panicking.
+func (emitter *Emitter) AddListener(event, listener interface{}) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.register(event, listener)
+	return emitter
+}
+
+// AddListenerErr adds the listener to the event like AddListener, but returns
+// the error of a failed registration, such as ErrNoneFunction, ErrNoOttoVM,
+// ErrClosed or the error of the RegistrationGuard, instead of supplying it to
+// the RecoveryListener or panicking with it, so callers can handle it inline.
+// The listener is not added when an error is returned.
+func (emitter *Emitter) AddListenerErr(event, listener interface{}) error {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	registration, err := emitter.validate(event, listener)
+
+	if nil != err {
+		return namedError(emitter.name, err)
+	}
+
+	emitter.add(event, registration)
+	return nil
+}
+
+// register validates the Go or otto listener and adds it to the event as
+// documented by AddListener, returning its registration or nil if it was
+// not added. The Emitter's mutex must be held by the caller.
+func (emitter *Emitter) register(event, listener interface{}) *listener {
+	registration := emitter.prepare(event, listener)
+
+	if nil == registration {
+		return nil
+	}
+
+	emitter.add(event, registration)
+	return registration
+}
+
+// add appends the registration to the Go or otto listeners of the event.
+// The Emitter's mutex must be held by the caller.
+func (emitter *Emitter) add(event interface{}, registration *listener) {
+	if registration.isOtto() {
+		emitter.addOttoListener(event, registration)
+	} else {
+		emitter.addListener(event, registration)
+	}
+}
+
+// prepare validates the listener of the event and returns its registration
+// without adding it, or nil after failing when the listener is invalid. The
+// Emitter's mutex must be held by the caller.
+func (emitter *Emitter) prepare(event, listener interface{}) *listener {
+	registration, err := emitter.validate(event, listener)
+
+	if nil != err {
+		emitter.fail(event, listener, err)
+		return nil
+	}
+
+	return registration
+}
+
+// validate returns the registration of the listener of the event without
+// adding it, or the error the registration fails with when the listener is
+// invalid or refused. The Emitter's mutex must be held by the caller.
+func (emitter *Emitter) validate(event, listener interface{}) (*listener, error) {
+	if err := emitter.check(listener); nil != err {
+		return nil, err
+	}
+
+	if nil != emitter.guard {
+		if err := emitter.guard(event, listener); nil != err {
+			return nil, err
+		}
+	}
+
+	if ottoFn, ok := listener.(otto.Value); ok {
+		return newOttoListener(ottoFn), nil
+	}
+
+	return newListener(reflect.ValueOf(listener)), nil
+}
+
+// check returns the error adding the listener to any event fails with, if
+// any, regardless of the RegistrationGuard. The Emitter's mutex must be held
+// by the caller.
+func (emitter *Emitter) check(listener interface{}) error {
+	if emitter.closed {
+		return ErrClosed
+	}
+
+	if !isListener(listener) {
+		return ErrNoneFunction
+	}
+
+	if _, ok := listener.(otto.Value); ok && nil == emitter.ottoVM {
+		return ErrNoOttoVM
+	}
+
+	return nil
+}
+
+// approve reports whether the RegistrationGuard, if any, approves adding the
+// listener to the event, else it fails with the guard's error. The Emitter's
+// mutex must be held by the caller.
+func (emitter *Emitter) approve(event, listener interface{}) bool {
+	if nil == emitter.guard {
+		return true
+	}
+
+	if err := emitter.guard(event, listener); nil != err {
+		emitter.fail(event, listener, err)
+		return false
+	}
+
+	return true
+}
+
+// addListener appends the Go listener to the event's listeners. The
+// Emitter's mutex must be held by the caller.
+func (emitter *Emitter) addListener(event interface{}, listener *listener) {
+	emitter.warnMaxListeners(event)
+	emitter.identify(listener)
+	emitter.events[event] = append(emitter.events[event], listener)
+}
+
+// addOttoListener appends the otto listener to the event's otto listeners.
+// The Emitter's mutex must be held by the caller.
+func (emitter *Emitter) addOttoListener(event interface{}, listener *listener) {
+	emitter.warnMaxListeners(event)
+	emitter.identify(listener)
+	emitter.ottoEvents[event] = append(emitter.ottoEvents[event], listener)
+}
+
+// identify assigns the next registration id of the Emitter to the listener
+// and tags it with the active group. The Emitter's mutex must be held by the
+// caller.
+func (emitter *Emitter) identify(listener *listener) {
+	emitter.registrations++
+	listener.id = emitter.registrations
+	listener.group = emitter.group
+}
+
+// warnMaxListeners prints a warning if adding a listener to the event
+// exceeds its maximum number of listeners, Go and otto listeners counting
+// alike. The Emitter's mutex must be held by the caller.
+func (emitter *Emitter) warnMaxListeners(event interface{}) {
+	count := len(emitter.events[event]) + len(emitter.ottoEvents[event])
+
+	if max := emitter.maxListenersFor(event); max != -1 && max < count+1 {
+		fmt.Fprintf(emitter.warnings, "Warning: %sevent `%v` has exceeded the maximum "+
+			"number of listeners of %d.\n", prefix(emitter.name), event, max)
+	}
+}
+
+// OnWithUnsub adds a listener whose first parameter is a func() which, when
+// called, removes that exact registration of the listener from the event.
+// The emitted arguments are supplied to the remaining parameters. This lets
+// a listener, even an anonymous one, remove itself once it is done. If the
+// listener's first parameter is not a func() then OnWithUnsub panics with
+// ErrNoneUnsubscribe, or calls the RecoveryListener if one has been set.
+func (emitter *Emitter) OnWithUnsub(event, listener interface{}) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	fn := reflect.ValueOf(listener)
+
+	if emitter.closed {
+		emitter.fail(event, listener, ErrClosed)
+		return emitter
+	}
+
+	if reflect.Func != fn.Kind() || 0 == fn.Type().NumIn() || unsubscribeType != fn.Type().In(0) {
+		emitter.fail(event, listener, ErrNoneUnsubscribe)
+		return emitter
+	}
+
+	if !emitter.approve(event, listener) {
+		return emitter
+	}
+
+	registration := newListener(fn)
+	unsubscribe := func() { emitter.removeRegistration(event, registration.id) }
+	registration.prefix = []reflect.Value{reflect.ValueOf(unsubscribe)}
+
+	emitter.addListener(event, registration)
+	return emitter
+}
+
+// OnWithEmitter adds a listener whose first parameter is supplied the Emitter
+// it was added to, before the emitted arguments, so handlers registered
+// generically, such as those provided by libraries, can emit follow-up events
+// or manage subscriptions without capturing the Emitter in a closure. The
+// parameter is either an *Emitter or an interface the Emitter implements,
+// such as EventEmitter. If it is neither then OnWithEmitter panics with
+// ErrNoneEmitter, or calls the RecoveryListener if one has been set. The
+// listener can be removed with RemoveListener.
+func (emitter *Emitter) OnWithEmitter(event, listener interface{}) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	fn := reflect.ValueOf(listener)
+
+	if emitter.closed {
+		emitter.fail(event, listener, ErrClosed)
+		return emitter
+	}
+
+	if reflect.Func != fn.Kind() || 0 == fn.Type().NumIn() || !emitterType.AssignableTo(fn.Type().In(0)) {
+		emitter.fail(event, listener, ErrNoneEmitter)
+		return emitter
+	}
+
+	if !emitter.approve(event, listener) {
+		return emitter
+	}
+
+	registration := newListener(fn)
+	registration.prefix = []reflect.Value{reflect.ValueOf(emitter)}
+
+	emitter.addListener(event, registration)
+	return emitter
+}
+
+// removeRegistration removes the registration of a Go listener with the id
+// from the event, leaving other registrations of the same function in place.
+func (emitter *Emitter) removeRegistration(event interface{}, id uint64) {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	var listeners []*listener
+
+	for _, listener := range emitter.events[event] {
+		if id != listener.id {
+			listeners = append(listeners, listener)
+		}
+	}
+
+	emitter.events[event] = listeners
+}
+
+// On is an alias for AddListener.
+func (emitter *Emitter) On(event, listener interface{}) *Emitter {
+	return emitter.AddListener(event, listener)
+}
+
+func (emitter *Emitter) JsOn(call otto.FunctionCall) otto.Value {
+	event := call.Argument(0)
+	listener := call.Argument(1)
+	e, err := event.Export()
+	if err != nil {
+		return otto.NullValue()
+	}
+	if event.IsString() {
+		e = e.(string)
+	}
+	emitter.AddListener(e, listener)
+	v, _ := emitter.ottoVM.ToValue(emitter)
+	return v
+}
+
+// OnRaw adds a listener which receives the emitted arguments as they were
+// supplied to Emit. Raw listeners are called directly rather than through
+// the reflect package, which makes them cheaper to emit to. AddListener
+// detects such listeners as well, OnRaw only enforces their signature.
+func (emitter *Emitter) OnRaw(event interface{}, listener func(...interface{})) *Emitter {
+	return emitter.AddListener(event, listener)
+}
+
+// OnMap adds a listener which receives the first argument emitted for the
+// event as a map, such as the payload emitted with EmitMap. A listener added
+// with OnMap panics with ErrNoneMap if the first argument is not a map, and
+// it can not be removed with RemoveListener as it is wrapped by the Emitter.
+func (emitter *Emitter) OnMap(event interface{}, listener func(map[string]interface{})) *Emitter {
+	return emitter.OnRaw(event, func(arguments ...interface{}) {
+		var payload map[string]interface{}
+
+		if 0 < len(arguments) {
+			var ok bool
+
+			if payload, ok = arguments[0].(map[string]interface{}); !ok {
+				panic(ErrNoneMap)
+			}
+		}
+
+		listener(payload)
+	})
+}
+
+// RemoveListener removes the listener argument from the event arguments slice
+// in the Emitter's events map, every registration of it if it was added more
+// than once. If the reflect Value of the listener does not have a Kind of
+// Func, or the listener is an otto.Value which is not a function, then
+// RemoveListener panics with ErrNoneFunction. If a RecoveryListener has been
+// set then it is called after recovering from the panic.
+func (emitter *Emitter) RemoveListener(event, listener interface{}) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if !isListener(listener) {
+		emitter.fail(event, listener, ErrNoneFunction)
+		return emitter
+	}
+
+	events := emitter.events
+
+	if _, isOttoValue := listener.(otto.Value); isOttoValue {
+		events = emitter.ottoEvents
+	}
+
+	if registrations, ok := events[event]; ok {
+		// Build a new slice without every registration of the listener,
+		// the listener may have been added more than once, instead of
+		// reslicing while ranging which skipped duplicates. The slice
+		// read by calls to Emit in flight is left untouched.
+		remaining := registrations[:0:0]
+
+		for _, registration := range registrations {
+			if !registration.is(listener) {
+				remaining = append(remaining, registration)
+			}
+		}
+
+		events[event] = remaining
+	}
+
+	return emitter
+}
+
+// ReplaceListener replaces the old listener of the event with the new one
+// under a single lock, so every Emit calls exactly one of them. The new
+// listener takes the place of the first registration of the old one, the
+// others are removed, or it is added last when the old listener is not a
+// listener of the event or of a different kind, Go or otto, than the new
+// one. The new listener keeps the registration it replaces: its id, group,
+// key, label, weight, the labels it is called after and whether it was
+// added with Once. Invalid listeners are rejected as by RemoveListener and
+// AddListener, leaving the event's listeners untouched.
+func (emitter *Emitter) ReplaceListener(event, old, new interface{}) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if !isListener(old) {
+		emitter.fail(event, old, ErrNoneFunction)
+		return emitter
+	}
+
+	registration := emitter.prepare(event, new)
+
+	if nil == registration {
+		return emitter
+	}
+
+	var goRegistration, ottoRegistration *listener
+
+	if registration.isOtto() {
+		ottoRegistration = registration
+	} else {
+		goRegistration = registration
+	}
+
+	placed := false
+
+	if listeners, ok := emitter.events[event]; ok {
+		var replaced bool
+
+		emitter.events[event], replaced = replaceListener(listeners, old, goRegistration)
+		placed = placed || replaced
+	}
+
+	if listeners, ok := emitter.ottoEvents[event]; ok {
+		var replaced bool
+
+		emitter.ottoEvents[event], replaced = replaceListener(listeners, old, ottoRegistration)
+		placed = placed || replaced
+	}
+
+	if placed {
+		return emitter
+	}
+
+	if registration.isOtto() {
+		emitter.addOttoListener(event, registration)
+	} else {
+		emitter.addListener(event, registration)
+	}
+
+	return emitter
+}
+
+// replaceListener returns a new slice of the listeners in which the first
+// registration of old is replaced by the registration, unless it is nil,
+// which inherits its attributes, and the others are removed, reporting
+// whether the registration was placed. The slice read by calls to Emit in
+// flight is left untouched.
+func replaceListener(listeners []*listener, old interface{}, registration *listener) ([]*listener, bool) {
+	replaced := make([]*listener, 0, len(listeners))
+	placed := false
+
+	for _, fn := range listeners {
+		if !fn.is(old) {
+			replaced = append(replaced, fn)
+			continue
+		}
+
+		if nil != registration && !placed {
+			registration.inherit(fn)
+			replaced = append(replaced, registration)
+			placed = true
+		}
+	}
+
+	return replaced, placed
+}
+
+// RemoveFirstListener removes the Go or otto listener of the event which was
+// added first, reporting whether the event had a listener to remove.
+func (emitter *Emitter) RemoveFirstListener(event interface{}) bool {
+	return emitter.removeEnd(event, false)
+}
+
+// RemoveLastListener removes the Go or otto listener of the event which was
+// added last, undoing its registration, and reports whether the event had a
+// listener to remove. Listeners can so be managed as a stack of overrides.
+func (emitter *Emitter) RemoveLastListener(event interface{}) bool {
+	return emitter.removeEnd(event, true)
+}
+
+// removeEnd removes the first or, if last is true, the last registration of
+// the event's Go and otto listeners, reporting whether one was removed.
+func (emitter *Emitter) removeEnd(event interface{}, last bool) bool {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	var (
+		end    *listener
+		events map[interface{}][]*listener
+	)
+
+	for _, candidates := range []map[interface{}][]*listener{emitter.events, emitter.ottoEvents} {
+		listeners := candidates[event]
+
+		if 0 == len(listeners) {
+			continue
+		}
+
+		candidate := listeners[0]
+
+		if last {
+			candidate = listeners[len(listeners)-1]
+		}
+
+		if nil == end || (last && candidate.id > end.id) || (!last && candidate.id < end.id) {
+			end, events = candidate, candidates
+		}
+	}
+
+	if nil == end {
+		return false
+	}
+
+	var remaining []*listener
+
+	for _, listener := range events[event] {
+		if end != listener {
+			remaining = append(remaining, listener)
+		}
+	}
+
+	events[event] = remaining
+	return true
+}
+
+// Off is an alias for RemoveListener.
+func (emitter *Emitter) Off(event, listener interface{}) *Emitter {
+	return emitter.RemoveListener(event, listener)
+}
+
+// Once adds a listener which is called by only one Emit before it is
+// removed from the event. The listener is removed, by its registration,
+// at the moment an Emit reads the event's listeners, so concurrent calls
+// to Emit can never both call it. Like any listener it can also be removed
+// before being called with RemoveListener. Once fails on invalid listeners
+// as documented by AddListener.
+func (emitter *Emitter) Once(event, listener interface{}) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if registration := emitter.register(event, listener); nil != registration {
+		registration.once = true
+	}
+
+	return emitter
+}
+
+// OnWithLabel adds a listener labelled with the label instead of its
+// function's name. The label identifies the listener in the Snapshot, to a
+// Tracer and to the listeners added with OnWithLabel. OnWithLabel fails on
+// invalid listeners as documented by AddListener.
+func (emitter *Emitter) OnWithLabel(event, listener interface{}, label string) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if registration := emitter.register(event, listener); nil != registration {
+		registration.label = label
+	}
+
+	return emitter
+}
+
+// OnIf adds a listener which is only called when the predicate, called with
+// the arguments of each emit, returns true. The predicate is either a
+// func(...interface{}) bool or, for otto listeners, also a JavaScript
+// function whose result is converted to a boolean; otherwise OnIf fails with
+// ErrNoneFunction. The predicate is called just before the listener, on the
+// same go routine and, for JavaScript predicates, on the same otto VM, and
+// its panics are recovered from like the listener's. OnIf fails on invalid
+// listeners as documented by AddListener.
+func (emitter *Emitter) OnIf(event, predicate, listener interface{}) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	filter, isFilter := predicate.(func(...interface{}) bool)
+	ottoFilter, isOttoFilter := predicate.(otto.Value)
+	_, isOttoListener := listener.(otto.Value)
+
+	if !isFilter && !(isOttoFilter && ottoFilter.IsFunction() && isOttoListener) {
+		emitter.fail(event, predicate, ErrNoneFunction)
+		return emitter
+	}
+
+	if registration := emitter.register(event, listener); nil != registration {
+		registration.filter, registration.ottoFilter = filter, ottoFilter
+	}
+
+	return emitter
+}
+
+// OnWithKey adds a listener identified by the key, any non-nil comparable
+// value, so it can be removed with OffByKey instead of by comparing
+// functions. This gives a deterministic way of removing closures and other
+// anonymous functions. OnWithKey fails on invalid listeners as documented by
+// AddListener.
+func (emitter *Emitter) OnWithKey(event, key, listener interface{}) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if registration := emitter.register(event, listener); nil != registration {
+		registration.key = key
+	}
+
+	return emitter
+}
+
+// OffByKey removes the Go and otto listeners of the event added with
+// OnWithKey and the key. Listeners added without a key are never removed by
+// OffByKey.
+func (emitter *Emitter) OffByKey(event, key interface{}) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if nil == key {
+		return emitter
+	}
+
+	for _, events := range []map[interface{}][]*listener{emitter.events, emitter.ottoEvents} {
+		listeners, ok := events[event]
+
+		if !ok {
+			continue
+		}
+
+		var remaining []*listener
+
+		for _, listener := range listeners {
+			if key != listener.key {
+				remaining = append(remaining, listener)
+			}
+		}
+
+		events[event] = remaining
+	}
+
+	return emitter
+}
+
+// Future is the pending result of the next emit of an event, see Await.
+type Future struct {
+	emitter *Emitter
+	event   interface{}
+	// Closed once the event is emitted or the Future stops awaiting it.
+	done chan struct{}
+	once sync.Once
+	// Copy of the arguments of the emit, or the error of the Future.
+	arguments []interface{}
+	err       error
+}
+
+// Await returns a Future resolved by the next emit of the event, for passing
+// the one-shot wait around as a value and resolving it elsewhere. The Future
+// adds a listener, with Once, as soon as Await is called, so emits made
+// before Get is called resolve it too. If the listener cannot be added, the
+// failure being handled as documented by AddListener, the Future's Get
+// returns ErrNotAwaiting.
+func (emitter *Emitter) Await(event interface{}) *Future {
+	future := &Future{emitter: emitter, event: event, done: make(chan struct{})}
+
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	registration := emitter.register(event, func(arguments ...interface{}) {
+		future.resolve(append([]interface{}(nil), arguments...), nil)
+	})
+
+	if nil == registration {
+		future.resolve(nil, ErrNotAwaiting)
+		return future
+	}
+
+	registration.once = true
+	registration.key = future
+	return future
+}
+
+// resolve settles the Future with the arguments or the error, unless it has
+// been settled already.
+func (future *Future) resolve(arguments []interface{}, err error) {
+	future.once.Do(func() {
+		future.arguments, future.err = arguments, err
+		close(future.done)
+	})
+}
+
+// Get blocks until the event awaited by the Future is emitted, returning a
+// copy of the arguments of the emit, or until the context is done, returning
+// the context's error. A Future stops awaiting its event when the context
+// of a Get is done first: its listener is removed and any later Get returns
+// ErrNotAwaiting. Once resolved, Get returns the same arguments every time.
+func (future *Future) Get(ctx context.Context) ([]interface{}, error) {
+	select {
+	case <-future.done:
+		return future.arguments, future.err
+	case <-ctx.Done():
+	}
+
+	future.emitter.OffByKey(future.event, future)
+	future.resolve(nil, ErrNotAwaiting)
+
+	// The Future may have been resolved by an emit meanwhile.
+	<-future.done
+
+	if nil == future.err {
+		return future.arguments, nil
+	}
+
+	return nil, ctx.Err()
+}
+
+// WaitForEvent blocks until the event is emitted, returning the arguments
+// of the emit and true, or until the timeout elapses, returning nil and
+// false. See WaitForEventContext.
+func (emitter *Emitter) WaitForEvent(event interface{}, timeout time.Duration) ([]interface{}, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	arguments, ok, _ := emitter.WaitForEventContext(ctx, event)
+	return arguments, ok
+}
+
+// WaitForEventContext blocks until the event is emitted, returning a copy of
+// the arguments of the emit and true, or until the context is done,
+// returning nil, false and the context's error. The temporary listener it
+// adds for the event is removed whichever happens first, and only the first
+// emit is waited for. If the temporary listener cannot be added, as on a
+// closed Emitter, nil, false and the error of the registration, such as
+// ErrClosed, are returned at once.
+func (emitter *Emitter) WaitForEventContext(ctx context.Context, event interface{}) ([]interface{}, bool, error) {
+	emitted := make(chan []interface{}, 1)
+	listener := func(arguments ...interface{}) {
+		select {
+		case emitted <- append([]interface{}(nil), arguments...):
+		default:
+		}
+	}
+
+	emitter.Lock()
+	registration, err := emitter.validate(event, listener)
+
+	if nil != err {
+		err = namedError(emitter.name, err)
+		emitter.Unlock()
+		return nil, false, err
+	}
+
+	// A new pointer identifies the temporary listener among those of
+	// concurrent waits, whose closures all compare equal.
+	key := new(byte)
+	registration.key = key
+	emitter.add(event, registration)
+	emitter.Unlock()
+
+	defer emitter.OffByKey(event, key)
+
+	select {
+	case arguments := <-emitted:
+		return arguments, true, nil
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// OnWithWeight adds a listener which counts as the weight, instead of one,
+// against the concurrency of the event set with SetEventConcurrency, so
+// heavy listeners take a larger share of the budget than light ones. A
+// listener heavier than the whole budget is called alone. Weights below one
+// count as one. Otto listeners called one after another on the Emitter's VM
+// count as one together regardless of their weights. OnWithWeight fails on
+// invalid listeners as documented by AddListener.
+func (emitter *Emitter) OnWithWeight(event, listener interface{}, weight int) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if 1 > weight {
+		weight = 1
+	}
+
+	if registration := emitter.register(event, listener); nil != registration {
+		registration.weight = weight
+	}
+
+	return emitter
+}
+
+// OnAfter adds a Go listener which, when the event is emitted, is called only
+// once the listeners of the event labelled afterLabel (see OnWithLabel) and
+// added before it have returned. Listeners not ordered by OnAfter are still
+// called concurrently, so OnAfter builds pipelines of stages without making
+// the whole event synchronous. Synchronous emits already call listeners in
+// the order they were added while EmitReverse, unwinding them, ignores the
+// ordering. Otto listeners are always called in the order they were added
+// and cannot be ordered after Go listeners. OnAfter fails on invalid
+// listeners as documented by AddListener.
+func (emitter *Emitter) OnAfter(event, listener interface{}, afterLabel string) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if registration := emitter.register(event, listener); nil != registration {
+		registration.after = afterLabel
+	}
+
+	return emitter
+}
+
+// Emit calls the listeners of the event with the arguments and waits for
+// them to return. Go listeners are called concurrently, each within its own
+// go routine, alongside the otto listeners called one after another, unless
+// the Emitter is synchronous (see SetSynchronous). Panics of listeners, such
+// as those of the reflect package when the arguments do not align the
+// parameters of a listener, and the errors they return are handled as
+// described by RecoverWith, and the arguments of otto listeners are
+// converted as described by SetOttoVM. See EmitContext, EmitErr and EmitSync
+// for the variants.
+func (emitter *Emitter) Emit(event interface{}, arguments ...interface{}) *Emitter {
+	return emitter.emit(emitOptions{}, event, arguments)
+}
+
+// EmitContext emits the event like Emit, supplying the context to the Go
+// listeners whose first parameter is a context.Context before the arguments.
+// Listeners without such a parameter are called with the arguments only, so
+// request-scoped values and cancellation reach the listeners which want them
+// without changing the signature of the event. The spans of a Tracer are
+// started from the context too.
+func (emitter *Emitter) EmitContext(ctx context.Context, event interface{}, arguments ...interface{}) *Emitter {
+	return emitter.emit(emitOptions{ctx: ctx}, event, arguments)
+}
+
+// EmitSync emits the event like Emit on a synchronous Emitter, calling its
+// listeners one after another on the current go routine in the order they
+// were added, Go listeners before otto listeners, see SetSynchronous. With a
+// RecoveryListener, a panicking listener is recovered from on its own so the
+// listeners after it are still called, as with Emit.
+func (emitter *Emitter) EmitSync(event interface{}, arguments ...interface{}) *Emitter {
+	return emitter.emit(emitOptions{synchronous: true}, event, arguments)
+}
+
+// EmitPeek emits the event like Emit, but skips the listeners added with
+// Once instead of calling and removing them, as if they were not registered,
+// so the event can be probed without consuming them. The UnhandledHandler is
+// called if the event only has listeners added with Once.
+func (emitter *Emitter) EmitPeek(event interface{}, arguments ...interface{}) *Emitter {
+	return emitter.emit(emitOptions{peek: true}, event, arguments)
+}
+
+// EmitBubbling emits the event like Emit and, if the event is a string of
+// dot separated names, then bubbles it up to its ancestors: emitting
+// "user.profile.updated" also emits to the listeners of "user.profile" and
+// then to those of "user", nearest first as with DOM events, once the
+// listeners of the event have returned. Listeners of ancestors receive the
+// full event name before the arguments, so coarse-grained observers know
+// which event occurred. The ancestors are not considered emitted themselves:
+// the LastEmitted time, AnyListeners and UnhandledHandler only see the event.
+// Every emit of an Emitter bubbles when bubbling is set, see SetBubbling.
+func (emitter *Emitter) EmitBubbling(event interface{}, arguments ...interface{}) *Emitter {
+	return emitter.emit(emitOptions{bubbling: true}, event, arguments)
+}
+
+// EmitFirst emits the event like EmitSync, calling its listeners one after
+// another in the order they were added, Go listeners before otto listeners,
+// until one of them returns a result, which is returned with true. The
+// remaining listeners are not called. The result of a Go listener is its
+// first result unless it is nil, or an error being its only result. The
+// result of an otto listener is its return value exported to Go unless it
+// is undefined or null. If no listener returns a result nil and false are
+// returned. As the listeners after the first result are not called, those
+// added with Once, such as the listeners of Await and WaitForEvent, are
+// skipped and kept for the next emit as with EmitPeek.
+func (emitter *Emitter) EmitFirst(event interface{}, arguments ...interface{}) (interface{}, bool) {
+	first := &firstResult{}
+
+	emitter.emit(emitOptions{first: first, peek: true}, event, arguments)
+	return first.value, first.found
+}
+
+// EmitReduce emits the event like EmitSync, calling its listeners one after
+// another in the order they were added, Go listeners before otto listeners,
+// and folds their results into an accumulator: starting from the initial
+// value, each result is passed to the aggregator with the accumulator, whose
+// return value becomes the new accumulator. The final accumulator is
+// returned. The result of a listener is as defined by EmitFirst: its first
+// result for Go listeners, the others being ignored, and its exported return
+// value for otto listeners. Listeners without a result, returning none, nil,
+// only an error, undefined or null, are not folded. The aggregator is called
+// on the listener's behalf, so its panics are recovered from like the
+// listener's.
+func (emitter *Emitter) EmitReduce(event interface{}, aggregator func(accumulator, result interface{}) interface{}, initial interface{}, arguments ...interface{}) interface{} {
+	reduced := &reduction{aggregator: aggregator, accumulator: initial}
+
+	emitter.emit(emitOptions{reduction: reduced}, event, arguments)
+	return reduced.accumulator
+}
+
+// EmitNamed emits the event like Emit with the positional arguments followed
+// by the named ones, so listeners may take either or both. Otto listeners
+// receive the named arguments as a plain JavaScript object, as if passed an
+// options object, whose properties are converted like the positional
+// arguments. Go listeners receive them as the map itself, their last
+// argument, and the names are not matched to their parameters. A nil map is
+// received as an empty object by otto listeners and as a nil map by Go
+// listeners.
+func (emitter *Emitter) EmitNamed(event interface{}, named map[string]interface{}, arguments ...interface{}) *Emitter {
+	return emitter.emit(emitOptions{named: true}, event, append(arguments[:len(arguments):len(arguments)], named))
+}
+
+// EmitValues emits the event like Emit with the arguments held by the reflect
+// Values, which Go listeners are called with as they are instead of taking
+// the reflect Value of each argument again, for callers building the
+// arguments through the reflect package. Raw listeners, AnyListeners and otto
+// listeners receive the values the reflect Values hold, so every value must
+// be valid and obtainable with Interface. The slice of values must not be
+// modified until EmitValues has returned.
+func (emitter *Emitter) EmitValues(event interface{}, values []reflect.Value) *Emitter {
+	arguments := make([]interface{}, 0, len(values))
+
+	for _, value := range values {
+		arguments = append(arguments, value.Interface())
+	}
+
+	return emitter.emit(emitOptions{values: values}, event, arguments)
+}
+
+// EmitWithRecover emits the event like Emit, but supplies the panics and
+// errors of its listeners to the RecoveryListener instead of the one set with
+// RecoverWith, for this call only. It avoids swapping the Emitter's
+// RecoveryListener around a critical emit, which races with other emits. If
+// nil is passed the Emitter's RecoveryListener is used.
+func (emitter *Emitter) EmitWithRecover(recoverer RecoveryListener, event interface{}, arguments ...interface{}) *Emitter {
+	return emitter.emit(emitOptions{recoverer: recoverer}, event, arguments)
+}
+
+// EmitReverse emits the event like a synchronous Emit, but calls its
+// listeners in the reverse order they were added, otto listeners before Go
+// listeners, mirroring the order of a synchronous Emit. This suits teardown
+// events whose listeners should unwind like deferred function calls.
+func (emitter *Emitter) EmitReverse(event interface{}, arguments ...interface{}) *Emitter {
+	return emitter.emit(emitOptions{reverse: true}, event, arguments)
+}
+
+// EmitParallel emits the event like Emit on an Emitter which is not
+// synchronous, calling each Go listener within its own go routine even if
+// the Emitter is synchronous. It lets synchronous Emitters opt into
+// concurrency for the events which benefit from it.
+func (emitter *Emitter) EmitParallel(event interface{}, arguments ...interface{}) *Emitter {
+	return emitter.emit(emitOptions{parallel: true}, event, arguments)
+}
+
+// Event describes an emitted event with its metadata, see EmitEvent.
+type Event struct {
+	// Name of the event, the key its listeners were added for.
+	Name interface{}
+	// Time the event was emitted at.
+	Timestamp time.Time
+	// Metadata on the context the event was emitted in.
+	Context map[string]interface{}
+}
+
+// EmitMetadata describes the emit a listener is called for, see
+// SetEmitSequence.
+type EmitMetadata struct {
+	// Sequence number of the emit, increasing by one with every emit of
+	// the Emitter starting from 1.
+	Sequence int64
+	// Event the listener was added for.
+	Event interface{}
+}
+
+// EventListener is a listener receiving the Event before the arguments, see
+// OnEvent.
+type EventListener func(Event, ...interface{})
+
+// EmitEvent emits the event named by ev.Name like Emit, supplying ev to the
+// listeners before the arguments so they learn when and in which context it
+// was emitted. A zero Timestamp is set to the current time. Every listener of
+// the event receives ev as its first argument, those added with OnEvent
+// included.
+func (emitter *Emitter) EmitEvent(ev Event, arguments ...interface{}) *Emitter {
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now()
+	}
+
+	return emitter.emit(emitOptions{}, ev.Name, append([]interface{}{ev}, arguments...))
+}
+
+// OnEvent adds a listener of the event named name which receives the Event
+// before the arguments. The event must be emitted with EmitEvent. The
+// listener can be removed with RemoveListener.
+func (emitter *Emitter) OnEvent(name interface{}, listener EventListener) *Emitter {
+	return emitter.AddListener(name, listener)
+}
+
+// emitOptions holds the options of a single call to emit.
+type emitOptions struct {
+	// Context of the emit, the background context if nil.
+	ctx context.Context
+	// Whether the listeners are called synchronously in the order they were
+	// added, as by a synchronous Emitter.
+	synchronous bool
+	// Collector of the errors of the listeners, see EmitErr, nil if the
+	// errors are supplied to the RecoveryListener.
+	errors *emitErrors
+	// RecoveryListener of the emit, the Emitter's if nil.
+	recoverer RecoveryListener
+	// Result of the first listener returning one, if looked for.
+	first *firstResult
+	// Fold of the results of the listeners, if any, see EmitReduce.
+	reduction *reduction
+	// Whether the listeners added with Once are skipped instead of removed.
+	peek bool
+	// Whether the event bubbles up to its ancestors, see EmitBubbling.
+	bubbling bool
+	// Whether the event is an ancestor of the event being emitted.
+	ancestor bool
+	// Whether the listeners are called synchronously in reverse order.
+	reverse bool
+	// Whether the listeners are called concurrently even if the Emitter
+	// is synchronous.
+	parallel bool
+	// Sequence number of the emit, of the event whose ancestor is emitted
+	// when bubbling, 0 if it has none.
+	sequence int64
+	// Whether the last argument holds named arguments, see EmitNamed.
+	named bool
+	// Reflect Values of the arguments, if given, see EmitValues.
+	values []reflect.Value
+	// Time the emit was queued at, when replayed by Unmute.
+	queued time.Time
+	// Whether the emit is the flush of coalesced emits, see CoalesceOnTick.
+	flushed bool
+}
+
+// emit calls the listeners of the event with the arguments as documented by
+// Emit, altered by the options.
+func (emitter *Emitter) emit(options emitOptions, event interface{}, arguments []interface{}) *Emitter {
+	var (
+		listeners     []*listener
+		ottoListeners []*listener
+		ottoOk        bool
+	)
+
+	// Lock the mutex when reading from the Emitter's
+	// events map.
+	emitter.Lock()
+
+	synchronous := (emitter.synchronous || options.synchronous || nil != options.first || nil != options.reduction || emitter.serialPerEvent) && !options.parallel
+	concurrency := emitter.concurrency[event]
+	strictOttoConversion := emitter.strictOttoConversion
+	shareStructArgs := emitter.shareStructArgs
+
+	var serial chan struct{}
+
+	emission := &emission{
+		ctx:            options.ctx,
+		tracer:         emitter.tracer,
+		metrics:        emitter.metrics,
+		invoker:        emitter.invoker,
+		event:          event,
+		arguments:      exportOttoValues(arguments),
+		errors:         options.errors,
+		recoverer:      options.recoverer,
+		name:           emitter.name,
+		failures:       emitter.failures,
+		panicFormatter: emitter.panicFormatter,
+		first:          options.first,
+		reduction:      options.reduction,
+		named:          options.named,
+		adaptPointers:  emitter.adaptPointers,
+		truncateArgs:   emitter.truncateArgs,
+		ottoPool:       emitter.ottoPool,
+		ottoCache:      emitter.ottoCache,
+		ottoVM:         emitter.ottoVM,
+		ottoThis:       emitter.ottoThis,
+	}
+
+	if nil == emission.ctx {
+		emission.ctx = context.Background()
+	}
+
+	if nil == emission.recoverer {
+		emission.recoverer = emitter.recoverer
+	}
+
+	if emitter.closed {
+		emitter.Unlock()
+		return emitter
+	}
+
+	if coalescer, ok := emitter.coalescers[event]; ok && !options.flushed && !options.ancestor {
+		coalescer.hold(arguments)
+		emitter.Unlock()
+		return emitter
+	}
+
+	// Checked before the listeners added with Once are removed, so only an
+	// emit which calls the listeners consumes them.
+	if mute, muted := emitter.muted[event]; muted {
+		mute.queue(arguments)
+		emitter.Unlock()
+		return emitter
+	}
+
+	listeners = emitter.events[event]
+	ottoListeners = emitter.ottoEvents[event]
+	ottoOk = 0 < len(ottoListeners)
+
+	if options.peek {
+		listeners = withoutOnce(listeners)
+		ottoListeners = withoutOnce(ottoListeners)
+		ottoOk = 0 < len(ottoListeners)
+	} else {
+		// Listeners added with Once are removed while the mutex is still
+		// held, so they are called by this Emit only.
+		removeOnce(emitter.events, event)
+		removeOnce(emitter.ottoEvents, event)
+	}
+
+	if emitter.sequencing && !options.ancestor {
+		emitter.sequence++
+		options.sequence = emitter.sequence
+	}
+
+	emission.sequence = options.sequence
+
+	if name, ok := event.(string); ok && !options.ancestor && (options.bubbling || emitter.bubbling) {
+		// Deferred so the ancestors are emitted to once the listeners
+		// of the event have returned.
+		defer emitter.bubble(options, name, arguments)
+	}
+
+	var (
+		anyListeners []AnyListener
+		sinks        []sink
+		unhandled    UnhandledHandler
+		errorEvent   interface{}
+		emitted      time.Time
+	)
+
+	// Emits to the ancestors of a bubbling event are part of the emit of
+	// the event itself.
+	if !options.ancestor {
+		emitted = time.Now()
+		emitter.lastEmitted[event] = emitted
+		anyListeners = emitter.anyListeners
+		sinks = emitter.sinks
+		unhandled = emitter.unhandled
+		errorEvent = emitter.errorEvent
+	}
+
+	if 0 == len(listeners) && !ottoOk {
+		// If the Emitter does not include the event in its
+		// event map, it has no listeners to Call yet.
+		emitter.Unlock()
+
+		emitter.callAnyListeners(emission, anyListeners)
+		emitter.record(sinks, event, arguments, emitted)
+
+		if nil != unhandled {
+			unhandled(event, arguments...)
+		}
+
+		if nil != errorEvent && errorEvent == event {
+			err := ErrUnhandledErrorEvent
+
+			if 0 < len(arguments) {
+				if emitted, ok := arguments[0].(error); ok {
+					err = emitted
+				}
+			}
+
+			emitter.failListener(emission, nil, err)
+		}
+
+		return emitter
+	}
+
+	// The channel serializing the emits of the event is only kept while
+	// some are in flight, see done.
+	if emitter.serialPerEvent && !options.parallel {
+		if serial = emitter.serials[event]; nil == serial {
+			serial = make(chan struct{}, 1)
+			emitter.serials[event] = serial
+		}
+	}
+
+	emitter.inflight++
+	emitter.running[event]++
+	defer emitter.done(event)
+
+	// Unlock the mutex immediately following the read
+	// instead of deferring so that listeners can call
+	// the Emitter's methods.
+	emitter.Unlock()
+
+	if nil != serial {
+		waiting := time.Now()
+		serial <- struct{}{}
+		defer func() { <-serial }()
+
+		if options.queued.IsZero() {
+			options.queued = waiting
+		}
+	}
+
+	if nil != emission.metrics && !options.queued.IsZero() {
+		emission.metrics.QueueWait(event, time.Since(options.queued))
+	}
+
+	if nil != emission.tracer {
+		var finish func()
+
+		emission.ctx, finish = emission.tracer.StartEmit(emission.ctx, event)
+		defer finish()
+	}
+
+	emitter.callAnyListeners(emission, anyListeners)
+	emitter.record(sinks, event, arguments, emitted)
+
+	// Convert the arguments for otto listeners before any listener
+	// goroutine is launched so that a failed conversion can only skip
+	// the otto listeners and never leaves the WaitGroup unbalanced. Events
+	// without otto listeners never convert their arguments, even when the
+	// Emitter has an otto VM.
+	if ottoOk && nil == emission.ottoVM {
+		for _, fn := range ottoListeners {
+			inter, _ := fn.ottoFn.Export()
+			emitter.failListener(emission, inter, ErrNoOttoVM)
+		}
+		ottoOk = false
+	}
+
+	if ottoOk {
+		for i := 0; i < len(arguments); i++ {
+			v, err := emission.toOttoValue(emission.ottoVM, i, arguments[i])
+			if err != nil {
+				emitter.Lock()
+				emitter.conversionErrors[event]++
+				emitter.Unlock()
+
+				err = fmt.Errorf("%w: argument %d: %w", ErrOttoConversion, i, err)
+
+				if strictOttoConversion {
+					panic(namedError(emission.name, err))
+				}
+
+				for _, fn := range ottoListeners {
+					inter, _ := fn.ottoFn.Export()
+					emitter.failListener(emission, inter, err)
+				}
+
+				ottoOk = false
+				break
+			}
+			emission.ottoValues = append(emission.ottoValues, v)
+		}
+	}
+
+	var (
+		wg     sync.WaitGroup
+		buffer *[]reflect.Value
+	)
+
+	// Listeners with the signature func(...interface{}) are called
+	// directly, so the reflect Values are only needed by the others.
+	reflective := false
+
+	for _, listener := range listeners {
+		if nil == listener.raw {
+			reflective = true
+			break
+		}
+	}
+
+	if reflective && nil != options.values {
+		emission.values = options.values
+	} else if reflective {
+		// Reuse an argument slice from the pool, the slice is owned by
+		// this call to Emit until every listener has returned.
+		buffer = valuesPool.Get().(*[]reflect.Value)
+		emission.values = (*buffer)[:0]
+
+		for i := 0; i < len(emission.arguments); i++ {
+			emission.values = append(emission.values, reflect.ValueOf(emission.arguments[i]))
+		}
+
+		if shareStructArgs && 1 == len(emission.values) && reflect.Struct == emission.values[0].Kind() {
+			// Copy the struct once into the pointer shared by the listeners,
+			// which is dereferenced for those taking the struct.
+			pointer := reflect.New(emission.values[0].Type())
+			pointer.Elem().Set(emission.values[0])
+			emission.values[0] = pointer
+			emission.adaptPointers = true
+		}
+	}
+
+	if options.reverse {
+		if ottoOk {
+			reversed := make([]*listener, 0, len(ottoListeners))
+
+			for i := len(ottoListeners) - 1; i >= 0; i-- {
+				reversed = append(reversed, ottoListeners[i])
+			}
+
+			emitter.callOttoListeners(emission, reversed)
+		}
+
+		for i := len(listeners) - 1; i >= 0; i-- {
+			emitter.callListener(emission, listeners[i])
+		}
+	} else if synchronous || (0 == len(listeners) && nil == emission.ottoPool) || (1 == len(listeners) && !ottoOk) {
+		// Synchronous Emitters and single listeners are called on the
+		// current go routine, avoiding the cost of spawning go routines
+		// and of the WaitGroup. Otto listeners are called one after
+		// another without a pool of VMs, so without Go listeners they
+		// are too.
+		for _, listener := range listeners {
+			if emission.answered() {
+				break
+			}
+
+			emitter.callListener(emission, listener)
+		}
+
+		if ottoOk && !emission.answered() {
+			emitter.callOttoListeners(emission, ottoListeners)
+		}
+	} else {
+		// Semaphore limiting the weight of the listeners called at once,
+		// nil when the event's concurrency is unlimited.
+		var semaphore *weightedSemaphore
+
+		if 0 < concurrency {
+			semaphore = newWeightedSemaphore(concurrency)
+		}
+
+		// First panic of the listeners when they are not recovered from,
+		// raised again once all of them have returned.
+		var panicked *firstPanic
+
+		if !emission.recovers() {
+			panicked = &firstPanic{}
+		}
+
+		// Channels closed once each listener has returned, only made when
+		// some listener waits on earlier ones, see OnAfter.
+		var returned []chan struct{}
+
+		for _, fn := range listeners {
+			if "" != fn.after {
+				returned = make([]chan struct{}, len(listeners))
+
+				for i := range returned {
+					returned[i] = make(chan struct{})
+				}
+
+				break
+			}
+		}
+
+		for i, fn := range listeners {
+			// Add to the WaitGroup only immediately before the
+			// go routine which is responsible for calling Done.
+			wg.Add(1)
+
+			go func(i int, fn *listener) {
+				defer wg.Done()
+				defer panicked.catch()
+
+				if nil != returned {
+					defer close(returned[i])
+
+					// Wait before acquiring the semaphore so waiting
+					// listeners never hold up the ones they wait on.
+					for j := 0; j < i && "" != fn.after; j++ {
+						if fn.after == listeners[j].label {
+							<-returned[j]
+						}
+					}
+				}
+
+				if nil != semaphore {
+					semaphore.acquire(fn.weight)
+					defer semaphore.release(fn.weight)
+				}
+
+				emitter.callListener(emission, fn)
+			}(i, fn)
+		}
+
+		if ottoOk && nil != emission.ottoPool {
+			// Each otto listener is called within its own go routine on
+			// a VM of the pool, see SetOttoVMPool.
+			for _, fn := range ottoListeners {
+				wg.Add(1)
+
+				go func(fn *listener) {
+					defer wg.Done()
+					defer panicked.catch()
+
+					if nil != semaphore {
+						semaphore.acquire(fn.weight)
+						defer semaphore.release(fn.weight)
+					}
+
+					emitter.callPooledOttoListener(emission, fn)
+				}(fn)
+			}
+		} else if ottoOk {
+			// The otto VM is not safe for concurrent use, so the otto
+			// listeners share a single go routine which runs alongside
+			// the Go listeners.
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+				defer panicked.catch()
+
+				if nil != semaphore {
+					semaphore.acquire(1)
+					defer semaphore.release(1)
+				}
+
+				emitter.callOttoListeners(emission, ottoListeners)
+			}()
+		}
+
+		wg.Wait()
+
+		// Deferred so that the argument slice is still returned to the
+		// pool below.
+		if nil != panicked && panicked.found {
+			defer panic(panicked.value)
+		}
+	}
+
+	if nil != buffer {
+		// Zero the values before returning them to the pool so the pool
+		// does not keep the arguments alive.
+		for i := range emission.values {
+			emission.values[i] = reflect.Value{}
+		}
+
+		*buffer = emission.values[:0]
+		valuesPool.Put(buffer)
+	}
+
+	return emitter
+}
+
+// emission holds the state shared by the listener calls of a single emit.
+type emission struct {
+	// Context of the emit, carrying the Tracer's span of the emit if any.
+	ctx context.Context
+	// Tracer starting a span around each listener call, if any.
+	tracer Tracer
+	// Metrics timing the emit and its listener calls, if any.
+	metrics Metrics
+	// Invoker wrapping each listener call, if any.
+	invoker Invoker
+	// Event being emitted.
+	event interface{}
+	// Arguments supplied to raw listeners.
+	arguments []interface{}
+	// Reflect Values of the arguments supplied to other Go listeners.
+	values []reflect.Value
+	// Collector of the errors of the listeners, if any.
+	errors *emitErrors
+	// RecoveryListener of the listeners, if any.
+	recoverer RecoveryListener
+	// Name of the Emitter prefixing the errors of the listeners, if any.
+	name string
+	// Channel the failures of the listeners are sent to, if any.
+	failures chan ListenerError
+	// PanicFormatter rendering the panics of the listeners, if any.
+	panicFormatter PanicFormatter
+	// Result of the first listener returning one, see EmitFirst.
+	first *firstResult
+	// Fold of the results of the listeners, see EmitReduce.
+	reduction *reduction
+	// Whether a single struct argument is adapted to the listeners, see
+	// SetAdaptPointers.
+	adaptPointers bool
+	// Whether extra arguments are dropped for listeners of fixed arity, see
+	// SetTruncateArgs.
+	truncateArgs bool
+	// Sequence number of the emit, 0 if emits are not numbered, see
+	// SetEmitSequence.
+	sequence int64
+	// Whether the last argument holds the named arguments of EmitNamed.
+	named bool
+	// Pool of otto VMs calling the otto listeners in parallel, if any.
+	ottoPool *ottoPool
+	// Cache of the otto Values of the arguments, if any.
+	ottoCache *ottoValueCache
+	// Otto VM of the otto listeners, and the this and arguments they are
+	// called with.
+	ottoVM     *otto.Otto
+	ottoThis   otto.Value
+	ottoValues []interface{}
+}
+
+// firstPanic holds the first panic of the listeners called within their own
+// go routines by an emit, see Emit.
+type firstPanic struct {
+	sync.Mutex
+	value interface{}
+	found bool
+}
+
+// catch recovers from a panic, keeping its value if it is the first. It must
+// be deferred, and does nothing on a nil firstPanic so that the panics are
+// then left to the listener calls.
+func (panicked *firstPanic) catch() {
+	if nil == panicked {
+		return
+	}
+
+	if r := recover(); nil != r {
+		panicked.Lock()
+		defer panicked.Unlock()
+
+		if !panicked.found {
+			panicked.value, panicked.found = r, true
+		}
+	}
+}
+
+// weightedSemaphore limits the total weight of the listeners being called.
+type weightedSemaphore struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// Total weight which may be held at once, and the weight held.
+	capacity, held int
+}
+
+// newWeightedSemaphore returns a weightedSemaphore of the capacity.
+func newWeightedSemaphore(capacity int) *weightedSemaphore {
+	semaphore := &weightedSemaphore{capacity: capacity}
+	semaphore.cond = sync.NewCond(&semaphore.mu)
+	return semaphore
+}
+
+// acquire blocks until the weight, at most the capacity, can be held.
+func (semaphore *weightedSemaphore) acquire(weight int) {
+	semaphore.mu.Lock()
+	defer semaphore.mu.Unlock()
+
+	if weight > semaphore.capacity {
+		weight = semaphore.capacity
+	}
+
+	for semaphore.held+weight > semaphore.capacity {
+		semaphore.cond.Wait()
+	}
+
+	semaphore.held += weight
+}
+
+// release releases the weight acquired with acquire.
+func (semaphore *weightedSemaphore) release(weight int) {
+	semaphore.mu.Lock()
+	defer semaphore.mu.Unlock()
+
+	if weight > semaphore.capacity {
+		weight = semaphore.capacity
+	}
+
+	semaphore.held -= weight
+	semaphore.cond.Broadcast()
+}
+
+// ottoPool is a pool of otto VMs calling otto listeners in parallel, see
+// SetOttoVMPool.
+type ottoPool struct {
+	// VMs which are not calling a listener.
+	vms chan *pooledVM
+}
+
+// pooledVM is an otto VM of an ottoPool.
+type pooledVM struct {
+	vm *otto.Otto
+	// Otto listeners compiled into the VM, by source.
+	compiled map[string]otto.Value
+}
+
+// compile returns the otto function fn compiled from its source into the VM,
+// compiling it only the first time.
+func (pooled *pooledVM) compile(fn otto.Value) (otto.Value, error) {
+	source := fn.String()
+
+	if compiled, ok := pooled.compiled[source]; ok {
+		return compiled, nil
+	}
+
+	compiled, err := pooled.vm.Run("(" + source + ")")
+
+	if nil != err {
+		return otto.Value{}, err
+	}
+
+	pooled.compiled[source] = compiled
+	return compiled, nil
+}
+
+// ottoValueCache is a least recently used cache of the otto Values of
+// cacheable arguments converted for the otto listeners of a VM, see
+// SetOttoValueCache.
+type ottoValueCache struct {
+	sync.Mutex
+	// VM the cached otto Values belong to.
+	vm *otto.Otto
+	// Maximum number of cached otto Values.
+	capacity int
+	// Cached otto Values, the most recently used first, and their elements
+	// by argument.
+	order   *list.List
+	entries map[interface{}]*list.Element
+}
+
+// cachedOttoValue is the otto Value of an argument held by an ottoValueCache.
+type cachedOttoValue struct {
+	argument interface{}
+	value    otto.Value
+}
+
+// newOttoValueCache returns an empty ottoValueCache of the capacity for the
+// otto Values of the VM.
+func newOttoValueCache(vm *otto.Otto, capacity int) *ottoValueCache {
+	return &ottoValueCache{vm: vm, capacity: capacity, order: list.New(), entries: make(map[interface{}]*list.Element)}
+}
+
+// get returns the cached otto Value of the argument, if any, marking it as
+// the most recently used.
+func (cache *ottoValueCache) get(argument interface{}) (otto.Value, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	element, ok := cache.entries[argument]
+
+	if !ok {
+		return otto.Value{}, false
+	}
+
+	cache.order.MoveToFront(element)
+	return element.Value.(*cachedOttoValue).value, true
+}
+
+// put caches the otto Value of the argument, evicting the least recently
+// used otto Value when the cache is full.
+func (cache *ottoValueCache) put(argument interface{}, value otto.Value) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if element, ok := cache.entries[argument]; ok {
+		element.Value.(*cachedOttoValue).value = value
+		cache.order.MoveToFront(element)
+		return
+	}
+
+	if cache.order.Len() >= cache.capacity {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cachedOttoValue).argument)
+	}
+
+	cache.entries[argument] = cache.order.PushFront(&cachedOttoValue{argument: argument, value: value})
+}
+
+// isCacheable reports whether the otto Value of the argument may be cached:
+// booleans, numbers and strings, and the structs and arrays made of them
+// only, whose conversion costs the most. Such arguments are comparable, and
+// so usable as keys of the cache, and hold no reference which could change
+// between emits. Arguments holding NaN are not cached as they are not equal
+// to themselves, so they could neither be found in nor evicted from it.
+func isCacheable(argument interface{}) bool {
+	switch argument.(type) {
+	case bool, string, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+	case nil:
+		return false
+	default:
+		if !isPlainType(reflect.TypeOf(argument)) {
+			return false
+		}
+	}
+
+	return argument == argument
+}
+
+// isPlainType reports whether the type is a boolean, number or string type,
+// or an array or struct type whose elements or fields are all plain types.
+func isPlainType(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Array:
+		return isPlainType(typ.Elem())
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			if !isPlainType(typ.Field(i).Type) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// OverflowPolicy decides which emit is dropped when the buffer of an event
+// muted with MuteBuffered is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest drops the oldest buffered emit to buffer the new one.
+	DropOldest OverflowPolicy = iota
+	// DropNewest drops the new emit, keeping the buffered ones.
+	DropNewest
+)
+
+// mute is the state of a muted event, see Mute and MuteBuffered.
+type mute struct {
+	// Maximum number of buffered emits, 0 if emits are dropped.
+	capacity int
+	// Policy applied when the buffer is full.
+	policy OverflowPolicy
+	// Whether emits with the same arguments as a buffered one are dropped.
+	coalesce bool
+	// Buffered emits in the order they were emitted.
+	buffer []bufferedEmit
+}
+
+// bufferedEmit is an emit of a muted event buffered by MuteBuffered.
+type bufferedEmit struct {
+	arguments []interface{}
+	// Time the emit was buffered at.
+	queued time.Time
+}
+
+// queue buffers the arguments of an emit of the muted event, if the mute
+// buffers emits, according to its policies.
+func (mute *mute) queue(arguments []interface{}) {
+	if 0 == mute.capacity {
+		return
+	}
+
+	if mute.coalesce {
+		for _, buffered := range mute.buffer {
+			if reflect.DeepEqual(buffered.arguments, arguments) {
+				return
+			}
+		}
+	}
+
+	if len(mute.buffer) >= mute.capacity {
+		if DropNewest == mute.policy {
+			return
+		}
+
+		mute.buffer = append(mute.buffer[:0:0], mute.buffer[len(mute.buffer)-mute.capacity+1:]...)
+	}
+
+	mute.buffer = append(mute.buffer, bufferedEmit{arguments: append([]interface{}(nil), arguments...), queued: time.Now()})
+}
+
+// coalescer holds the latest emit of an event coalesced until the next tick,
+// see CoalesceOnTick.
+type coalescer struct {
+	// Arguments of the latest emit, and the number of emits coalesced into
+	// it, 0 if none is pending.
+	arguments []interface{}
+	pending   int
+	// Closed to stop the flusher of the event.
+	stop chan struct{}
+}
+
+// hold replaces the pending emit with an emit of the arguments.
+func (coalescer *coalescer) hold(arguments []interface{}) {
+	coalescer.arguments = append([]interface{}(nil), arguments...)
+	coalescer.pending++
+}
+
+// take returns the arguments of the pending emit and whether there is one,
+// which is no longer pending.
+func (coalescer *coalescer) take() ([]interface{}, bool) {
+	arguments, pending := coalescer.arguments, 0 < coalescer.pending
+	coalescer.arguments, coalescer.pending = nil, 0
+	return arguments, pending
+}
+
+// firstResult holds the result of the first listener of an emit returning
+// one, see EmitFirst.
+type firstResult struct {
+	value interface{}
+	found bool
+}
+
+// reduction folds the results of the listeners of an emit, see EmitReduce.
+type reduction struct {
+	aggregator  func(accumulator, result interface{}) interface{}
+	accumulator interface{}
+}
+
+// collects reports whether the results of the listeners of the emission are
+// looked for, by EmitFirst or EmitReduce.
+func (emission *emission) collects() bool {
+	return nil != emission.first || nil != emission.reduction
+}
+
+// collect records the result of a listener of the emission for EmitFirst or
+// folds it into the accumulator of EmitReduce.
+func (emission *emission) collect(result interface{}) {
+	if nil != emission.first {
+		emission.first.value, emission.first.found = result, true
+	}
+
+	if nil != emission.reduction {
+		emission.reduction.accumulator = emission.reduction.aggregator(emission.reduction.accumulator, result)
+	}
+}
+
+// measure reports the duration of the call of the listener with the label,
+// started at the time, to the emission's Metrics. It must be deferred.
+func (emission *emission) measure(label string, started time.Time) {
+	emission.metrics.ListenerDuration(emission.event, label, time.Since(started))
+}
+
+// answered reports whether a listener of the emission returned the result
+// looked for by EmitFirst, so the remaining listeners are skipped.
+func (emission *emission) answered() bool {
+	return nil != emission.first && emission.first.found
+}
+
+// isNil reports whether the reflect Value is nil, values of kinds which
+// cannot be nil never are.
+func isNil(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		return value.IsNil()
+	}
+
+	return false
+}
+
+// recovers reports whether the panics of the listeners of the emission are
+// recovered from, that is whether it has a RecoveryListener or a channel of
+// failures, or collects the errors of its listeners.
+func (emission *emission) recovers() bool {
+	return nil != emission.recoverer || nil != emission.failures || nil != emission.errors
+}
+
+// emitErrors collects the errors of the listeners of an emit, see EmitErr.
+type emitErrors struct {
+	sync.Mutex
+	errs []error
+}
+
+// bubble emits the event, with the arguments and options of its emit, to each
+// of its ancestors, from the nearest to the root, see EmitBubbling.
+func (emitter *Emitter) bubble(options emitOptions, event string, arguments []interface{}) {
+	forwarded := append([]interface{}{event}, arguments...)
+	options.ancestor = true
+	options.values = nil
+
+	for i := strings.LastIndex(event, "."); 0 < i; i = strings.LastIndex(event[:i], ".") {
+		emitter.emit(options, event[:i], forwarded)
+	}
+}
+
+// removeOnce replaces the event's listeners in the map with a new slice
+// without the listeners added with Once, leaving slices already read by
+// calls to Emit untouched. The Emitter's mutex must be held by the caller.
+func removeOnce(events map[interface{}][]*listener, event interface{}) {
+	listeners := events[event]
+
+	if remaining := withoutOnce(listeners); len(remaining) != len(listeners) {
+		events[event] = remaining
+	}
+}
+
+// withoutOnce returns the listeners without those added with Once, in a new
+// slice if there are any, else the listeners themselves.
+func withoutOnce(listeners []*listener) []*listener {
+	for i, fn := range listeners {
+		if !fn.once {
+			continue
+		}
+
+		remaining := append([]*listener(nil), listeners[:i]...)
+
+		for _, fn := range listeners[i+1:] {
+			if !fn.once {
+				remaining = append(remaining, fn)
+			}
+		}
+
+		return remaining
+	}
+
+	return listeners
+}
+
+// fail sends err to the channel returned by Errors and supplies it to the
+// RecoveryListener if either has been set, else it panics with err. The
+// Emitter's mutex must be held by the caller.
+func (emitter *Emitter) fail(event, listener interface{}, err error) {
+	err = namedError(emitter.name, err)
+
+	if nil != emitter.failures && !sendFailure(emitter.failures, ListenerError{Event: event, Listener: listener, Err: err}) {
+		emitter.errorDrops[event]++
+	}
+
+	if nil == emitter.recoverer {
+		if nil != emitter.failures {
+			return
+		}
+
+		panic(err)
+	}
+
+	if r := recoverFrom(emitter.recoverer, event, listener, err); nil != r {
+		emitter.warnRecoverer(event, r, err)
+	}
+}
+
+// failListener supplies err, the failure of a listener of the emission, to
+// the errors collected by EmitErr if the emission collects them, else it
+// fails like fail with the channel and RecoveryListener of the emission.
+func (emitter *Emitter) failListener(emission *emission, listener interface{}, err error) {
+	if nil == emission.errors {
+		err = namedError(emission.name, err)
+
+		if nil != emission.failures && !sendFailure(emission.failures, ListenerError{Event: emission.event, Listener: listener, Err: err}) {
+			emitter.Lock()
+			emitter.errorDrops[emission.event]++
+			emitter.Unlock()
+		}
+
+		if nil == emission.recoverer {
+			if nil != emission.failures {
+				return
+			}
+
+			panic(err)
+		}
+
+		if r := recoverFrom(emission.recoverer, emission.event, listener, err); nil != r {
+			emitter.Lock()
+			emitter.warnRecoverer(emission.event, r, err)
+			emitter.Unlock()
+		}
+
+		return
+	}
+
+	emission.errors.Lock()
+	defer emission.errors.Unlock()
+
+	emission.errors.errs = append(emission.errors.errs, namedError(emission.name, err))
+}
+
+// recoverFrom calls the RecoveryListener with the failure of the listener of
+// the event, returning the value it panicked with, if any, so that a buggy
+// RecoveryListener cannot crash the program.
+func recoverFrom(recoverer RecoveryListener, event, listener interface{}, err error) (r interface{}) {
+	defer func() {
+		r = recover()
+	}()
+
+	recoverer(event, listener, err)
+	return nil
+}
+
+// warnRecoverer prints a warning that the RecoveryListener panicked with r
+// while handling err, the failure of a listener of the event. The Emitter's
+// mutex must be held by the caller.
+func (emitter *Emitter) warnRecoverer(event, r interface{}, err error) {
+	fmt.Fprintf(emitter.warnings, "Warning: %sRecoveryListener panicked with `%v` "+
+		"handling `%v` of event `%v`.\n", prefix(emitter.name), r, err, event)
+}
+
+// sendFailure sends the failure to the channel unless it is full, reporting
+// whether it was sent.
+func sendFailure(failures chan<- ListenerError, failure ListenerError) bool {
+	select {
+	case failures <- failure:
+		return true
+	default:
+		return false
+	}
+}
+
+// EmitErr emits the event like Emit, but returns the errors of its listeners
+// instead of supplying them to the RecoveryListener or panicking with them:
+// recovered panics, errors returned by Go listeners and the errors, such as
+// ErrNoOttoVM, of otto listeners which could not be called. The errors are
+// in the order the listeners failed, which is unspecified for listeners
+// called concurrently. A nil slice is returned when every listener
+// succeeded.
+func (emitter *Emitter) EmitErr(event interface{}, arguments ...interface{}) []error {
+	collected := &emitErrors{}
+
+	emitter.emit(emitOptions{errors: collected}, event, arguments)
+	return collected.errs
+}
+
+// EmitErrContext emits the event like EmitErr, supplying the context to the
+// listeners as EmitContext does, but returns as soon as the context is done
+// if that happens before every listener has returned. It returns the errors
+// of the listeners which failed by then together with the context's error,
+// which is nil if the listeners returned first. Both are always reported: a
+// cancellation never hides the listener errors already collected, and
+// listener errors never hide the cancellation. Listeners still running when
+// the context is done keep running in the background, as with EmitDeadline.
+// If the context is done already the event is not emitted at all.
+func (emitter *Emitter) EmitErrContext(ctx context.Context, event interface{}, arguments ...interface{}) ([]error, error) {
+	if err := ctx.Err(); nil != err {
+		return nil, err
+	}
+
+	collected := &emitErrors{}
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		emitter.emit(emitOptions{ctx: ctx, errors: collected}, event, arguments)
+	}()
+
+	select {
+	case <-done:
+		return collected.errs, nil
+	case <-ctx.Done():
+	}
+
+	collected.Lock()
+	defer collected.Unlock()
+
+	return append([]error(nil), collected.errs...), ctx.Err()
+}
+
+// EmitJoin emits the event like EmitErr, joining the errors of its listeners
+// into a single error naming the event, or returning nil if every listener
+// succeeded. The individual errors can still be matched with errors.Is and
+// errors.As.
+func (emitter *Emitter) EmitJoin(event interface{}, arguments ...interface{}) error {
+	errs := emitter.EmitErr(event, arguments...)
+
+	if 0 == len(errs) {
+		return nil
+	}
+
+	return fmt.Errorf("event `%v`: %w", event, errors.Join(errs...))
+}
+
+// EmitDeadline emits the event like Emit, but waits for its listeners only
+// until the deadline, returning ErrDeadlineExceeded if some of them have not
+// returned by then. Listeners still running at the deadline are neither
+// interrupted nor abandoned, they keep running in the background and the
+// Emitter counts the emit as in flight until they return (see WaitIdle).
+// The deadline bounds the emit as a whole, individual listeners are never
+// timed out.
+func (emitter *Emitter) EmitDeadline(deadline time.Time, event interface{}, arguments ...interface{}) error {
+	done := emitter.EmitNotify(event, arguments...)
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return ErrDeadlineExceeded
+	}
+}
+
+// EmitNotify emits the event like Emit on a new go routine, returning a
+// channel which is closed once every listener has returned. Unlike Emit it
+// does not block, so the completion can be selected on alongside other
+// channels such as timeouts or cancellations. Panics of listeners are
+// recovered from as with Emit. The emit counts as in flight as soon as
+// EmitNotify returns, so WaitIdle and Close wait for it.
+func (emitter *Emitter) EmitNotify(event interface{}, arguments ...interface{}) <-chan struct{} {
+	done := make(chan struct{})
+
+	// Counted on the calling go routine, as the new go routine may only
+	// run once WaitIdle has returned.
+	emitter.Lock()
+	emitter.inflight++
+	emitter.running[event]++
+	emitter.Unlock()
+
+	go func() {
+		defer close(done)
+		defer emitter.done(event)
+
+		emitter.Emit(event, arguments...)
+	}()
+
+	return done
+}
+
+// EmitAsyncErr emits the event like EmitErr on a new go routine, returning a
+// channel which receives the error of each failing listener, as returned by
+// EmitErr, and is closed once every listener has returned, even if the event
+// has no listeners. Unlike EmitErr it does not block, suiting background
+// dispatch whose failures are still observed eventually by ranging over the
+// channel. The channel is buffered to the number of listeners of the event
+// when EmitAsyncErr is called, so the go routine of the emit never waits for
+// the errors to be received and callers may stop receiving them. Errors of
+// listeners added meanwhile which do not fit in the buffer are dropped and
+// counted as Stats.ErrorDrops.
+func (emitter *Emitter) EmitAsyncErr(event interface{}, arguments ...interface{}) <-chan error {
+	emitter.Lock()
+	errs := make(chan error, len(emitter.events[event])+len(emitter.ottoEvents[event])+len(emitter.anyListeners))
+	emitter.Unlock()
+
+	go func() {
+		defer close(errs)
+
+		for _, err := range emitter.EmitErr(event, arguments...) {
+			select {
+			case errs <- err:
+			default:
+				emitter.Lock()
+				emitter.errorDrops[event]++
+				emitter.Unlock()
+			}
+		}
+	}()
+
+	return errs
+}
+
+// EmitMap emits the event with the payload as its only argument. Otto
+// listeners receive the payload as a JavaScript object.
+func (emitter *Emitter) EmitMap(event interface{}, payload map[string]interface{}) *Emitter {
+	return emitter.Emit(event, payload)
+}
+
+// done marks a call to Emit of the event as returned, waking up calls to
+// WaitIdle once none are in flight, and dropping the channel serializing
+// the emits of the event once none of them are.
+func (emitter *Emitter) done(event interface{}) {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if emitter.running[event]--; 0 == emitter.running[event] {
+		delete(emitter.running, event)
+		delete(emitter.serials, event)
+	}
+
+	if emitter.inflight--; 0 == emitter.inflight {
+		emitter.idle.Broadcast()
+	}
+}
+
+// WaitIdle blocks until no calls to Emit are in flight, that is until the
+// listeners of every event being emitted have returned. WaitIdle must not
+// be called by a listener, which would wait on itself.
+func (emitter *Emitter) WaitIdle() {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	for 0 < emitter.inflight {
+		emitter.idle.Wait()
+	}
+}
+
+// callListener calls the listener with the arguments of the emission, through
+// the emission's Invoker if any, unless its predicate rejects them. Potential
+// panics are recovered from and supplied to the RecoveryListener if one has
+// been set, else the panic is allowed to occur.
+func (emitter *Emitter) callListener(emission *emission, listener *listener) {
+	if nil != emission.tracer {
+		defer emission.tracer.StartListener(emission.ctx, emission.event, listener.label)()
+	}
+
+	if nil != emission.metrics {
+		defer emission.measure(listener.label, time.Now())
+	}
+
+	if emission.recovers() {
+		defer func() {
+			if r := recover(); nil != r {
+				emitter.failListener(emission, listener.fn.Interface(), emitter.recovered(emission, r))
+			}
+		}()
+	}
+
+	if nil != listener.filter && !listener.filter(emission.arguments...) {
+		return
+	}
+
+	if nil != emission.invoker {
+		emission.invoker(func() { emitter.invokeListener(emission, listener) }, emission.event, listener.label)
+		return
+	}
+
+	emitter.invokeListener(emission, listener)
+}
+
+// invokeListener calls the listener with the arguments of the emission,
+// directly if it is a raw listener or else through the reflect package with
+// the reflect Values of the arguments, and handles its results.
+func (emitter *Emitter) invokeListener(emission *emission, listener *listener) {
+	if nil != listener.raw {
+		listener.raw(emission.arguments...)
+		return
+	}
+
+	values := emission.values
+	index := len(listener.prefix)
+	sequenced := 0 < emission.sequence && nil != listener.sequenced
+
+	if listener.contextual {
+		index++
+	}
+
+	if sequenced {
+		index++
+	}
+
+	if typ := listener.fn.Type(); emission.truncateArgs && !typ.IsVariadic() {
+		if max := typ.NumIn() - index; 0 <= max && max < len(values) {
+			values = values[:max]
+		}
+	}
+
+	if emission.adaptPointers && 1 == len(values) {
+		values = adaptPointer(listener.fn.Type(), index, values)
+	}
+
+	if 0 < len(listener.prefix) || listener.contextual || sequenced {
+		prefixed := make([]reflect.Value, 0, 2+len(listener.prefix)+len(values))
+
+		if listener.contextual {
+			prefixed = append(prefixed, reflect.ValueOf(emission.ctx))
+		}
+
+		if int64Type == listener.sequenced && sequenced {
+			prefixed = append(prefixed, reflect.ValueOf(emission.sequence))
+		} else if sequenced {
+			prefixed = append(prefixed, reflect.ValueOf(EmitMetadata{Sequence: emission.sequence, Event: emission.event}))
+		}
+
+		values = append(append(prefixed, listener.prefix...), values...)
+	}
+
+	results := listener.fn.Call(values)
+
+	// A sole error result is an error rather than the listener's answer.
+	if emission.collects() && 0 < len(results) && !(listener.failing && 1 == len(results)) {
+		if result := results[0]; !isNil(result) {
+			emission.collect(result.Interface())
+		}
+	}
+
+	if !listener.failing || !emission.recovers() {
+		return
+	}
+
+	if err := results[len(results)-1]; !err.IsNil() {
+		emitter.failListener(emission, listener.fn.Interface(), err.Interface().(error))
+	}
+}
+
+// adaptPointer returns the values, holding a single struct or pointer to a
+// struct, with the value referenced or dereferenced to match the type of the
+// function's parameter at the index. The values are returned unchanged when
+// they already match or cannot be adapted.
+func adaptPointer(typ reflect.Type, index int, values []reflect.Value) []reflect.Value {
+	if index >= typ.NumIn() || (typ.IsVariadic() && index == typ.NumIn()-1) {
+		return values
+	}
+
+	param := typ.In(index)
+	value := values[0]
+
+	switch {
+	case reflect.Struct == value.Kind() && reflect.Ptr == param.Kind() && value.Type() == param.Elem():
+		// The listener receives a pointer to a copy of the struct.
+		pointer := reflect.New(value.Type())
+		pointer.Elem().Set(value)
+		return []reflect.Value{pointer}
+	case reflect.Ptr == value.Kind() && !value.IsNil() && reflect.Struct == param.Kind() && value.Type().Elem() == param:
+		return []reflect.Value{value.Elem()}
+	}
+
+	return values
+}
+
+// toOttoValue converts the argument to an otto Value of the VM. A
+// json.RawMessage is parsed with JSON.parse into a JavaScript value, objects
+// included, instead of being converted as an array of bytes, and an otto
+// Value is passed through as is.
+func toOttoValue(vm *otto.Otto, argument interface{}) (otto.Value, error) {
+	if raw, ok := argument.(json.RawMessage); ok {
+		return vm.Call("JSON.parse", nil, string(raw))
+	}
+
+	if value, ok := argument.(otto.Value); ok {
+		return value, nil
+	}
+
+	return vm.ToValue(argument)
+}
+
+// toOttoValue converts the argument at the index of the emission's arguments
+// to an otto Value of the VM like toOttoValue, except for the named arguments
+// of EmitNamed which are converted to a JavaScript object.
+func (emission *emission) toOttoValue(vm *otto.Otto, index int, argument interface{}) (otto.Value, error) {
+	if named, ok := argument.(map[string]interface{}); ok && emission.named && index == len(emission.arguments)-1 {
+		return toOttoObject(vm, named)
+	}
+
+	if cache := emission.ottoCache; nil != cache && vm == cache.vm && isCacheable(argument) {
+		if value, ok := cache.get(argument); ok {
+			return value, nil
+		}
+
+		value, err := toOttoValue(vm, argument)
+
+		if nil == err {
+			cache.put(argument, value)
+		}
+
+		return value, err
+	}
+
+	return toOttoValue(vm, argument)
+}
+
+// toOttoObject converts the named values to a plain JavaScript object of the
+// VM, each value converted like toOttoValue, with the properties defined in
+// the order of their names.
+func toOttoObject(vm *otto.Otto, named map[string]interface{}) (otto.Value, error) {
+	object, err := vm.Object("({})")
+
+	if nil != err {
+		return otto.Value{}, err
+	}
+
+	names := make([]string, 0, len(named))
+
+	for name := range named {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		value, err := toOttoValue(vm, named[name])
+
+		if nil == err {
+			err = object.Set(name, value)
+		}
+
+		if nil != err {
+			return otto.Value{}, err
+		}
+	}
+
+	return object.Value(), nil
+}
+
+// exportOttoValues returns the arguments with the otto Values among them
+// exported to Go values, in a new slice if there are any, else the arguments
+// themselves. Values which cannot be exported are kept as is.
+func exportOttoValues(arguments []interface{}) []interface{} {
+	var exported []interface{}
+
+	for i, argument := range arguments {
+		value, ok := argument.(otto.Value)
+
+		if !ok {
+			continue
+		}
+
+		if nil == exported {
+			exported = append(arguments[:0:0], arguments...)
+		}
+
+		if inter, err := value.Export(); nil == err {
+			exported[i] = inter
+		}
+	}
+
+	if nil == exported {
+		return arguments
+	}
+
+	return exported
+}
+
+// OttoFunction wraps the Go function as a JavaScript function of the VM, so
+// a single implementation can be added both as a Go listener and as an otto
+// listener. The JavaScript arguments are converted by otto to the types of
+// the function's parameters, as for any Go function set on the VM, and calls
+// panic with a TypeError when they cannot be. The wrapper is a native
+// function, so the VMs of a pool cannot compile it, see SetOttoVMPool. It
+// returns ErrNoneFunction if fn is not a function.
+func OttoFunction(vm *otto.Otto, fn interface{}) (otto.Value, error) {
+	if nil == fn || reflect.Func != reflect.TypeOf(fn).Kind() {
+		return otto.Value{}, ErrNoneFunction
+	}
+
+	return vm.ToValue(fn)
+}
+
+// GoFunction wraps the JavaScript function of the VM as a Go function, so a
+// single implementation can be added both as an otto listener and as a Go
+// listener. The wrapper converts its arguments to otto Values as Emit does
+// for otto listeners, json.RawMessage included, and returns the error of a
+// failed conversion or of the function throwing, which Emit supplies to the
+// RecoveryListener. Otto VMs are not safe for concurrent use, so the wrapper
+// must only be called while nothing else uses the VM: add it to synchronous
+// Emitters, or emit with EmitSync, when the VM also runs otto listeners. It
+// returns ErrNoneFunction if fn is not a function.
+func GoFunction(vm *otto.Otto, fn otto.Value) (func(...interface{}) error, error) {
+	if !fn.IsFunction() {
+		return nil, ErrNoneFunction
+	}
+
+	return func(arguments ...interface{}) error {
+		values := make([]interface{}, 0, len(arguments))
+
+		for _, argument := range arguments {
+			value, err := toOttoValue(vm, argument)
+
+			if nil != err {
+				return err
+			}
+
+			values = append(values, value)
+		}
+
+		_, err := fn.Call(otto.UndefinedValue(), values...)
+		return err
+	}, nil
+}
+
+// callOttoListeners calls each otto listener in turn with the otto this and
+// values of the emission. The listeners belong to the emission's otto VM, if
+// the Emitter's VM is removed or replaced before a listener is called then
+// the listener is not called and ErrNoOttoVM or ErrOttoVMReplaced is supplied
+// to the RecoveryListener, or panicked with, instead.
+func (emitter *Emitter) callOttoListeners(emission *emission, listeners []*listener) {
+	for _, listener := range listeners {
+		if emission.answered() {
+			return
+		}
+
+		if emitter.ottoVMCurrent(emission, listener) {
+			emitter.callOttoListener(emission, listener, listener.ottoFn, listener.ottoFilter, emission.ottoThis, emission.ottoValues)
+		}
+	}
+}
+
+// ottoVMCurrent reports whether the Emitter's otto VM is still the VM of the
+// emission, else it fails the otto listener with ErrNoOttoVM or
+// ErrOttoVMReplaced.
+func (emitter *Emitter) ottoVMCurrent(emission *emission, listener *listener) bool {
+	emitter.Lock()
+	current := emitter.ottoVM
+	emitter.Unlock()
+
+	if emission.ottoVM == current {
+		return true
+	}
+
+	err := ErrOttoVMReplaced
+
+	if nil == current {
+		err = ErrNoOttoVM
+	}
+
+	inter, _ := listener.ottoFn.Export()
+	emitter.failListener(emission, inter, err)
+	return false
+}
+
+// callPooledOttoListener calls the otto listener on a VM of the emission's
+// pool, waiting for one to be free, with the listener's function compiled
+// into the VM and the arguments of the emission converted for it. Failures
+// to compile or convert are supplied to the RecoveryListener, or panicked
+// with.
+func (emitter *Emitter) callPooledOttoListener(emission *emission, listener *listener) {
+	if !emitter.ottoVMCurrent(emission, listener) {
+		return
+	}
+
+	pooled := <-emission.ottoPool.vms
+	defer func() { emission.ottoPool.vms <- pooled }()
+
+	fn, err := pooled.compile(listener.ottoFn)
+	filter := listener.ottoFilter
+
+	if nil == err && filter.IsFunction() {
+		filter, err = pooled.compile(filter)
+	}
+	values := make([]interface{}, 0, len(emission.arguments))
+
+	for i := 0; nil == err && i < len(emission.arguments); i++ {
+		var v otto.Value
+
+		if v, err = emission.toOttoValue(pooled.vm, i, emission.arguments[i]); nil == err {
+			values = append(values, v)
+		} else {
+			err = fmt.Errorf("%w: argument %d: %w", ErrOttoConversion, i, err)
+		}
+	}
+
+	if nil != err {
+		inter, _ := listener.ottoFn.Export()
+		emitter.failListener(emission, inter, err)
+		return
+	}
+
+	emitter.callOttoListener(emission, listener, fn, filter, otto.NullValue(), values)
+}
+
+// callOttoListener calls fn, the function of the otto listener, with the this
+// and values, through the emission's Invoker if any, unless the listener's
+// predicate, either a Go function or the JavaScript function filter, rejects
+// them. Potential panics are recovered from and supplied to the
+// RecoveryListener if one has been set, else the panic is allowed to occur.
+func (emitter *Emitter) callOttoListener(emission *emission, listener *listener, fn, filter, this otto.Value, values []interface{}) {
+	if nil != emission.tracer {
+		defer emission.tracer.StartListener(emission.ctx, emission.event, listener.label)()
+	}
+
+	if nil != emission.metrics {
+		defer emission.measure(listener.label, time.Now())
+	}
+
+	if emission.recovers() {
+		defer func() {
+			if r := recover(); nil != r {
+				inter, _ := listener.ottoFn.Export()
+				emitter.failListener(emission, inter, emitter.recovered(emission, r))
+			}
+		}()
+	}
+
+	if nil != listener.filter && !listener.filter(emission.arguments...) {
+		return
+	}
+
+	if filter.IsFunction() {
+		accepted, _ := filter.Call(this, values...)
+
+		if ok, _ := accepted.ToBoolean(); !ok {
+			return
+		}
+	}
+
+	if nil != emission.invoker {
+		emission.invoker(func() { emitter.invokeOttoListener(emission, fn, this, values) }, emission.event, listener.label)
+		return
+	}
+
+	emitter.invokeOttoListener(emission, fn, this, values)
+}
+
+// invokeOttoListener calls fn, the function of an otto listener, with the
+// this and values, and records its result.
+func (emitter *Emitter) invokeOttoListener(emission *emission, fn, this otto.Value, values []interface{}) {
+	result, _ := fn.Call(this, values...)
+
+	if emission.collects() && result.IsDefined() && !result.IsNull() {
+		if exported, err := result.Export(); nil == err {
+			emission.collect(exported)
+		}
+	}
+}
+
+// recovered counts the panic of a listener of the emission and returns the
+// value recovered from it rendered as an error, see panicError.
+func (emitter *Emitter) recovered(emission *emission, r interface{}) error {
+	emitter.Lock()
+	emitter.panics[emission.event]++
+	emitter.Unlock()
+
+	return panicError(emission.panicFormatter, r)
+}
+
+// panicError renders the value recovered from a panic as an error with the
+// PanicFormatter if there is one, else with its default format.
+func panicError(formatter PanicFormatter, r interface{}) error {
+	if nil != formatter {
+		return formatter(r)
+	}
+
+	return errors.New(fmt.Sprintf("%v", r))
+}
+
+// namedError prefixes the message of err with the name of an Emitter, if it
+// has one, wrapping err so it can still be matched with errors.Is.
+func namedError(name string, err error) error {
+	if "" == name {
+		return err
+	}
+
+	return fmt.Errorf("%s%w", prefix(name), err)
+}
+
+// prefix returns the name of an Emitter formatted as a prefix for messages,
+// or an empty string if the Emitter has no name.
+func prefix(name string) string {
+	if "" == name {
+		return ""
+	}
+
+	return fmt.Sprintf("emitter `%s` ", name)
+}
+
+// RecoverWith sets the listener to call when a panic occurs, recovering from
+// panics and attempting to keep the application from crashing. Panics of the
+// RecoveryListener itself are recovered from too, and reported as warnings
+// (see SetWarningWriter). Non-nil errors returned, as their last result, by
+// Go listeners are supplied to the RecoveryListener too, or ignored if none
+// has been set. Without a RecoveryListener the first panic of the listeners
+// of an emit is raised again, unchanged, on the go routine which called
+// Emit once the other listeners have returned, the later panics being lost.
+func (emitter *Emitter) RecoverWith(listener RecoveryListener) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.recoverer = listener
+	return emitter
+}
+
+// Errors returns the channel receiving the failures of the Emitter's
+// listeners, of every event, as an alternative to the callback of
+// RecoverWith for consumers handling failures asynchronously: recovered
+// panics, errors returned by Go listeners and failed registrations. Once
+// Errors has been called, panics of listeners are recovered from even
+// without a RecoveryListener, which is still called after the failure is
+// sent if one has been set. The channel buffers DefaultErrorsBuffer failures
+// and is never closed. Failures it has no room for, nobody reading it, are
+// dropped and counted in the ErrorDrops of Stats rather than blocking the
+// emit. Failures returned by EmitErr and its variants are not sent. Every
+// call returns the same channel.
+func (emitter *Emitter) Errors() <-chan ListenerError {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if nil == emitter.failures {
+		emitter.failures = make(chan ListenerError, DefaultErrorsBuffer)
+	}
+
+	return emitter.failures
+}
+
+// HasRecoverer reports whether a RecoveryListener has been set with
+// RecoverWith, that is whether panics of listeners are recovered from
+// instead of propagating. It lets wrappers install a default RecoveryListener
+// only when none has been set.
+func (emitter *Emitter) HasRecoverer() bool {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	return nil != emitter.recoverer
+}
+
+// MaxListeners returns the maximum number of listeners per event of the
+// Emitter, -1 meaning events may have unlimited listeners.
+func (emitter *Emitter) MaxListeners() int {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	return emitter.maxListeners
+}
+
+// SetEventMaxListeners sets the maximum number of listeners for the event,
+// overriding the Emitter's maximum set with SetMaxListeners. If -1 is passed
+// as the maximum, the event may have unlimited listeners.
+func (emitter *Emitter) SetEventMaxListeners(event interface{}, max int) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.eventMaxListeners[event] = max
+	return emitter
+}
+
+// EventMaxListeners returns the maximum number of listeners for the event,
+// which is the Emitter's maximum unless it was overridden for the event with
+// SetEventMaxListeners.
+func (emitter *Emitter) EventMaxListeners(event interface{}) int {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	return emitter.maxListenersFor(event)
+}
+
+// maxListenersFor returns the maximum number of listeners for the event. The
+// Emitter's mutex must be held by the caller.
+func (emitter *Emitter) maxListenersFor(event interface{}) int {
+	if max, ok := emitter.eventMaxListeners[event]; ok {
+		return max
+	}
+
+	return emitter.maxListeners
+}
+
+// HasOttoVM reports whether the Emitter has an otto VM, which is required
+// for adding and emitting to otto listeners.
+func (emitter *Emitter) HasOttoVM() bool {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	return nil != emitter.ottoVM
+}
+
+// SetName sets the name identifying the Emitter in the warnings it prints
+// and the errors it supplies to the RecoveryListener, which is useful when
+// an application has many Emitters.
+func (emitter *Emitter) SetName(name string) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.name = name
+	return emitter
+}
+
+// Name returns the name of the Emitter, empty unless one has been set.
+func (emitter *Emitter) Name() string {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	return emitter.name
+}
+
+// OnAny adds a listener called with the event and arguments of every emit,
+// whether or not the event has listeners of its own, for observers such as
+// loggers and auditors which see every event including those added later.
+// AnyListeners are called one after another, in the order they were added,
+// on the emitting go routine before the event's own listeners. Their panics
+// are recovered from like those of other listeners.
+func (emitter *Emitter) OnAny(listener AnyListener) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if nil != listener {
+		emitter.anyListeners = append(emitter.anyListeners, listener)
+	}
+
+	return emitter
+}
+
+// OffAny removes the listener added with OnAny.
+func (emitter *Emitter) OffAny(listener AnyListener) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	fn := reflect.ValueOf(listener)
+
+	var remaining []AnyListener
+
+	for _, registered := range emitter.anyListeners {
+		if fn != reflect.ValueOf(registered) {
+			remaining = append(remaining, registered)
+		}
+	}
+
+	emitter.anyListeners = remaining
+	return emitter
+}
+
+// EmittedRecord is the record of an emit sent to the channels of SinkTo.
+type EmittedRecord struct {
+	// Event emitted.
+	Event interface{}
+	// Arguments of the emit, in a slice of the record's own.
+	Args []interface{}
+	// Time the event was emitted at.
+	Time time.Time
+}
+
+// sink is a channel every emit is recorded to, see SinkTo.
+type sink struct {
+	ch       chan<- EmittedRecord
+	blocking bool
+}
+
+// SinkTo mirrors every emit of the Emitter, of any event, to the channel as
+// an EmittedRecord, for piping the emits into a persistence layer or over a
+// WebSocket. Records are sent on the emitting go routine after the
+// AnyListeners are called and before the event's own listeners. A blocking
+// sink waits for the channel to receive each record, holding up the emit,
+// while a non-blocking sink drops the records the channel has no room for,
+// and counts them in the SinkDrops of Stats. Emits to the ancestors of a
+// bubbling event are not recorded, nor are muted emits until replayed. The
+// channel is detached with Unsink.
+func (emitter *Emitter) SinkTo(ch chan<- EmittedRecord, blocking bool) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if nil != ch {
+		emitter.sinks = append(emitter.sinks, sink{ch: ch, blocking: blocking})
+	}
+
+	return emitter
+}
+
+// Unsink stops mirroring the emits of the Emitter to the channel, see
+// SinkTo. Calls to Emit in flight may still send their record.
+func (emitter *Emitter) Unsink(ch chan<- EmittedRecord) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	var remaining []sink
+
+	for _, registered := range emitter.sinks {
+		if ch != registered.ch {
+			remaining = append(remaining, registered)
+		}
+	}
+
+	emitter.sinks = remaining
+	return emitter
+}
+
+// record sends the record of an emit of the event to each of the sinks.
+func (emitter *Emitter) record(sinks []sink, event interface{}, arguments []interface{}, emitted time.Time) {
+	for _, registered := range sinks {
+		record := EmittedRecord{Event: event, Args: append(arguments[:0:0], arguments...), Time: emitted}
+
+		if registered.blocking {
+			registered.ch <- record
+			continue
+		}
+
+		select {
+		case registered.ch <- record:
+		default:
+			emitter.Lock()
+			emitter.sinkDrops[event]++
+			emitter.Unlock()
+		}
+	}
+}
+
+// callAnyListeners calls each AnyListener in turn with the event and
+// arguments of the emission, recovering from their panics as callListener.
+func (emitter *Emitter) callAnyListeners(emission *emission, listeners []AnyListener) {
+	for _, listener := range listeners {
+		func() {
+			if emission.recovers() {
+				defer func() {
+					if r := recover(); nil != r {
+						emitter.failListener(emission, listener, emitter.recovered(emission, r))
+					}
+				}()
+			}
+
+			listener(emission.event, emission.arguments...)
+		}()
+	}
+}
+
+// SetUnhandledHandler sets the function called when an event without any
+// listeners is emitted, for detecting and logging misrouted events. By
+// default, or if nil is passed, such emits do nothing.
+func (emitter *Emitter) SetUnhandledHandler(handler UnhandledHandler) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.unhandled = handler
+	return emitter
+}
+
+// SetEmitSequence sets whether the Emitter numbers its emits, of any event,
+// from 1 so listeners can detect emits delivered out of order or twice, as
+// they may be when calling Emit from several go routines. Go listeners whose
+// first parameter, after the context.Context if any, is an int64 or an
+// EmitMetadata are then supplied the number of the emit there, before the
+// emitted arguments. As this changes what listeners taking an int64 as their
+// first argument receive, numbering is off by default. The emits of the
+// ancestors of a bubbling event share the number of the event's emit, and
+// emits buffered by MuteBuffered are numbered when replayed. Raw and otto
+// listeners are never supplied the number.
+func (emitter *Emitter) SetEmitSequence(enabled bool) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.sequencing = enabled
+	return emitter
+}
+
+// SetRegistrationGuard sets the function approving every registration of a
+// valid listener, made by AddListener, On, Once or any other method adding
+// listeners, so that policies such as the events a tenant's scripts may
+// listen to are enforced in one place. When the guard returns an error the
+// listener is not added and the registration fails with the error, which is
+// supplied to the RecoveryListener if one has been set or else panicked
+// with. AnyListeners, which are not added for an event, are not submitted to
+// the guard. The guard is called with the Emitter's mutex held, so it must
+// not call the Emitter's methods. By default, or if nil is passed, every
+// registration is approved.
+func (emitter *Emitter) SetRegistrationGuard(guard RegistrationGuard) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.guard = guard
+	return emitter
+}
+
+// SetErrorEvent designates the event as the Emitter's error event, like the
+// "error" event of Node's EventEmitter: emitting it without any Go or otto
+// listeners fails instead of doing nothing, so errors are not lost when
+// nothing subscribes to them. The emitted error, the first argument if it is
+// an error or else ErrUnhandledErrorEvent, is panicked with, supplied to the
+// RecoveryListener with a nil listener if one has been set, or returned by
+// EmitErr. AnyListeners are not listeners of the error event in this
+// respect. By default, or if nil is passed, no event is the error event.
+func (emitter *Emitter) SetErrorEvent(event interface{}) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.errorEvent = event
+	return emitter
+}
+
+// SetInvoker sets the Invoker the Emitter calls instead of each Go and otto
+// listener, for cross-cutting concerns such as injecting a tenant's context
+// or counting panics in metrics without changing the listeners. The Invoker
+// calls next to call the listener, or skips it by returning without doing
+// so. It is called within the Tracer's span and the Metrics' timing, after
+// the listener's predicate (see OnIf) accepted the arguments, and its
+// panics, as well as those of the listener raised through next, are
+// recovered from and supplied to the RecoveryListener like any listener
+// panic. Next must be called before the Invoker returns, as emits, those of
+// EmitDeadline included, do not wait for listener calls made afterwards.
+// Passing nil removes the Invoker.
+func (emitter *Emitter) SetInvoker(invoker Invoker) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.invoker = invoker
+	return emitter
+}
+
+// SetMetrics sets the Metrics recording the time emits wait before their
+// listeners are called and the time each listener call takes. Passing nil
+// removes the Metrics.
+func (emitter *Emitter) SetMetrics(metrics Metrics) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.metrics = metrics
+	return emitter
+}
+
+// SetTracer sets the Tracer starting a span around each emit which finds
+// listeners for its event, and a child span around each of its listener
+// calls. Emit and the other methods without a context start the spans of
+// emits from the background context. Passing nil removes the Tracer.
+func (emitter *Emitter) SetTracer(tracer Tracer) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.tracer = tracer
+	return emitter
+}
+
+// SetPanicFormatter sets the function rendering values recovered from the
+// panics of Go and otto listeners as the errors supplied to the
+// RecoveryListener. By default the error's message is the value formatted
+// with fmt's %v verb.
+func (emitter *Emitter) SetPanicFormatter(formatter PanicFormatter) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.panicFormatter = formatter
+	return emitter
+}
+
+// SetWarningWriter sets the writer of the Emitter's warnings, such as those
+// about events exceeding their maximum number of listeners, which is stdout
+// by default. Passing io.Discard silences the warnings.
+func (emitter *Emitter) SetWarningWriter(w io.Writer) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.warnings = w
+	return emitter
+}
+
+// SetMaxListeners sets the maximum number of listeners per
+// event for the Emitter. If -1 is passed as the maximum,
+// all events may have unlimited listeners. By default, each
+// event can have a maximum number of 10 listeners which is
+// useful for finding memory leaks.
+func (emitter *Emitter) SetMaxListeners(max int) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.maxListeners = max
+	return emitter
+}
+
+// SetAdaptPointers sets whether an event emitted with a single argument which
+// is a struct, or a pointer to one, is referenced or dereferenced as needed
+// to match the parameter of each Go listener, so listeners of the same event
+// may receive either a pointer or a value. Listeners taking a pointer while a
+// struct value is emitted receive a pointer to a copy of it, so their changes
+// are not seen by the other listeners. Nil pointers are never dereferenced.
+// The adaptation is disabled by default.
+func (emitter *Emitter) SetAdaptPointers(adapt bool) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.adaptPointers = adapt
+	return emitter
+}
+
+// SetShareStructArgs sets whether an event emitted with a single argument
+// which is a struct shares one copy of it between its Go listeners, so that
+// large payloads fanned out to many listeners are not copied for each of
+// them. The struct is copied once per emit behind a pointer which listeners
+// taking a pointer to the struct all receive, while listeners taking the
+// struct itself still receive their own copy, and listeners taking an
+// interface receive the pointer. Raw listeners, AnyListeners and otto
+// listeners receive the struct as emitted. As the listeners taking a pointer
+// share it, changes made by one of them are seen by the others, possibly
+// while they read it concurrently, so the pointer must be treated as read
+// only. Sharing is disabled by default. Arguments emitted with EmitValues are
+// never shared.
+func (emitter *Emitter) SetShareStructArgs(share bool) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.shareStructArgs = share
+	return emitter
+}
+
+// SetTruncateArgs sets whether Go listeners which are not variadic are called
+// with only as many of the emitted arguments as they have parameters, the
+// extra trailing arguments being ignored as JavaScript functions do, instead
+// of the call panicking. Missing arguments still make the call panic. The
+// truncation is disabled by default.
+func (emitter *Emitter) SetTruncateArgs(truncate bool) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.truncateArgs = truncate
+	return emitter
+}
+
+// SetBubbling sets whether every event emitted by the Emitter bubbles up
+// to its ancestors as with EmitBubbling. Bubbling is disabled by default.
+func (emitter *Emitter) SetBubbling(bubbling bool) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.bubbling = bubbling
+	return emitter
+}
+
+// SetSynchronous sets whether Emit calls the listeners of an event one after
+// another on the current go routine instead of each within its own go
+// routine. Synchronous listeners are called in the order they were added,
+// Go listeners before otto listeners, and a slow listener delays every
+// listener after it. In exchange no go routines are spawned, which is
+// cheaper for fast listeners, and dispatch is deterministic.
+func (emitter *Emitter) SetSynchronous(synchronous bool) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.synchronous = synchronous
+	return emitter
+}
+
+// SetSerialPerEvent sets whether the Emitter serializes the emits of each
+// event while different events are still emitted concurrently, a middle
+// ground between the default, where every listener may run at once, and a
+// synchronous Emitter, where the emits of all events run one after another
+// when emitted from a single go routine. Each emit calls its listeners one
+// after another on the current go routine, as on a synchronous Emitter, and
+// waits for earlier emits of the same event, from any go routine, to return
+// before calling them, so the listeners of an event never race each other.
+// A listener must therefore not emit its own event on its go routine, which
+// would wait for itself forever. Listeners are read before waiting, so
+// listeners added or removed meanwhile are handled as by Emit in flight.
+// EmitParallel ignores the mode.
+func (emitter *Emitter) SetSerialPerEvent(serial bool) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.serialPerEvent = serial
+	return emitter
+}
+
+// SetEventConcurrency sets the maximum number of the event's listeners
+// which Emit calls at once, the otto listeners counting as one as they are
+// called one after another. Listeners added with OnWithWeight count as their
+// weight instead, so the maximum is a budget for the total weight of the
+// listeners being called. If 0 or less is passed as the maximum, which is
+// the default, all of the event's listeners are called at once. Other events
+// are not affected.
+func (emitter *Emitter) SetEventConcurrency(event interface{}, max int) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if 0 < max {
+		emitter.concurrency[event] = max
+	} else {
+		delete(emitter.concurrency, event)
+	}
+
+	return emitter
+}
+
+// ListenerCount returns the number of Go and otto listeners of the event.
+func (emitter *Emitter) ListenerCount(event interface{}) int {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	return len(emitter.events[event]) + len(emitter.ottoEvents[event])
+}
+
+// IndexOfListener returns the position of the first registration of the
+// listener within its event's listeners, in the order they are called by
+// synchronous emits, or -1 if it is not a listener of the event. Go and otto
+// listeners are kept apart, so the position of an otto listener only counts
+// the otto listeners before it. Listeners are matched as RemoveListener
+// matches them.
+func (emitter *Emitter) IndexOfListener(event, listener interface{}) int {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	listeners := emitter.events[event]
+
+	if _, ok := listener.(otto.Value); ok {
+		listeners = emitter.ottoEvents[event]
+	}
+
+	for i, registration := range listeners {
+		if registration.is(listener) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// EventNames returns the events which have Go or otto listeners, sorted so
+// the result is reproducible. Events are ordered by the name of their type
+// first, then by value for strings, numbers and booleans. Events of other
+// kinds, which have no natural order, are ordered by their %v formatting as a
+// tie-break, and events formatted alike keep an unspecified order.
+func (emitter *Emitter) EventNames() []interface{} {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	var names []interface{}
+
+	for event, listeners := range emitter.events {
+		if 0 < len(listeners) {
+			names = append(names, event)
+		}
+	}
+
+	for event, listeners := range emitter.ottoEvents {
+		// Events with Go listeners are already named.
+		if 0 < len(listeners) && 0 == len(emitter.events[event]) {
+			names = append(names, event)
+		}
+	}
+
+	sort.Slice(names, func(i, j int) bool { return lessEvent(names[i], names[j]) })
+	return names
+}
+
+// EventNamesMatching returns the events which have Go or otto listeners and
+// which the predicate accepts, in the order of EventNames, for example the
+// events whose name starts with "db.". Events are passed to the predicate
+// as they were added, whatever their type, so it must check the type of
+// events which are not strings. The predicate is called once the Emitter's
+// mutex has been released, so it may call the Emitter's methods.
+func (emitter *Emitter) EventNamesMatching(predicate func(event interface{}) bool) []interface{} {
+	names := emitter.EventNames()
+	matching := names[:0]
+
+	for _, event := range names {
+		if predicate(event) {
+			matching = append(matching, event)
+		}
+	}
+
+	if 0 == len(matching) {
+		return nil
+	}
+
+	return matching
+}
+
+// lessEvent reports whether the event a is ordered before the event b, see
+// EventNames.
+func lessEvent(a, b interface{}) bool {
+	if typeA, typeB := fmt.Sprintf("%T", a), fmt.Sprintf("%T", b); typeA != typeB {
+		return typeA < typeB
+	}
+
+	valueA, valueB := reflect.ValueOf(a), reflect.ValueOf(b)
+
+	switch valueA.Kind() {
+	case reflect.String:
+		return valueA.String() < valueB.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return valueA.Int() < valueB.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return valueA.Uint() < valueB.Uint()
+	case reflect.Float32, reflect.Float64:
+		return valueA.Float() < valueB.Float()
+	case reflect.Bool:
+		return !valueA.Bool() && valueB.Bool()
+	}
+
+	return fmt.Sprintf("%v", a) < fmt.Sprintf("%v", b)
+}
+
+// Mute suspends the event: until it is unmuted, emitting it does nothing,
+// its listeners are not called and the emit is not recorded, while the
+// listeners stay registered. Listeners may still be added and removed.
+func (emitter *Emitter) Mute(event interface{}) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if _, muted := emitter.muted[event]; !muted {
+		emitter.muted[event] = &mute{}
+	}
+
+	return emitter
+}
+
+// MuteBuffered mutes the event like Mute, but buffers up to capacity of its
+// emits while muted to replay them in order when it is unmuted, deferring the
+// work of a critical section. Once the buffer is full the policy decides
+// whether the oldest buffered emit or the new one is dropped. If coalesce is
+// true, emits with the same arguments, compared with reflect.DeepEqual, as
+// an emit already buffered are dropped. Muting an event which is muted
+// already changes its policies but keeps the emits buffered so far. A
+// capacity below 0 counts as 0, buffering nothing as Mute. The arguments of
+// buffered emits are kept until they are replayed, while the Emitter keeps
+// no reference to the arguments of other emits once they have returned.
+func (emitter *Emitter) MuteBuffered(event interface{}, capacity int, policy OverflowPolicy, coalesce bool) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if 0 > capacity {
+		capacity = 0
+	}
+
+	state, muted := emitter.muted[event]
+
+	if !muted {
+		state = &mute{}
+		emitter.muted[event] = state
+	}
+
+	state.capacity, state.policy, state.coalesce = capacity, policy, coalesce
+	return emitter
+}
+
+// Unmute resumes the event muted with Mute, later emits calling its
+// listeners again. The emits buffered by MuteBuffered are replayed first,
+// in the order they were emitted, before Unmute returns.
+func (emitter *Emitter) Unmute(event interface{}) *Emitter {
+	emitter.Lock()
+
+	var buffer []bufferedEmit
+
+	if mute, muted := emitter.muted[event]; muted {
+		buffer = mute.buffer
+		delete(emitter.muted, event)
+	}
+
+	emitter.Unlock()
+
+	for _, buffered := range buffer {
+		emitter.emit(emitOptions{queued: buffered.queued}, event, buffered.arguments)
+	}
+
+	return emitter
+}
+
+// CoalesceOnTick collapses the emits of the event into one per interval: an
+// emit is held instead of calling the listeners, replacing the emit held
+// before it if any, and the latest emit held is emitted on a background go
+// routine at the next tick of the interval, for rate-limiting events such as
+// renders to the latest state. Unlike a debounce the emit is made at fixed
+// ticks whether or not emits keep arriving. The number of emits held since
+// the last tick is reported by PendingCoalesced, and Flush emits the held
+// emit without waiting for the tick. Calling CoalesceOnTick again changes
+// the interval, keeping the held emit. The emits of the ancestors of a
+// bubbling event are not coalesced. StopCoalescing stops the coalescing, and
+// Close stops it too, dropping the held emit. An interval of 0 or less stops
+// the coalescing like StopCoalescing.
+func (emitter *Emitter) CoalesceOnTick(event interface{}, interval time.Duration) *Emitter {
+	if 0 >= interval {
+		return emitter.StopCoalescing(event)
+	}
+
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if emitter.closed {
+		return emitter
+	}
+
+	state, ok := emitter.coalescers[event]
+
+	if ok {
+		close(state.stop)
+	} else {
+		state = &coalescer{}
+		emitter.coalescers[event] = state
+	}
+
+	stop := make(chan struct{})
+	state.stop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				emitter.Flush(event)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return emitter
+}
+
+// Flush emits the emit of the event held by CoalesceOnTick, if any, on the
+// current go routine without waiting for the next tick.
+func (emitter *Emitter) Flush(event interface{}) *Emitter {
+	emitter.Lock()
+
+	var (
+		arguments []interface{}
+		pending   bool
+	)
+
+	if state, ok := emitter.coalescers[event]; ok {
+		arguments, pending = state.take()
+	}
+
+	emitter.Unlock()
+
+	if pending {
+		emitter.emit(emitOptions{flushed: true}, event, arguments)
+	}
+
+	return emitter
+}
+
+// PendingCoalesced returns the number of emits of the event collapsed into
+// the emit held by CoalesceOnTick since the last tick or Flush, 0 if no emit
+// is held.
+func (emitter *Emitter) PendingCoalesced(event interface{}) int {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if state, ok := emitter.coalescers[event]; ok {
+		return state.pending
+	}
+
+	return 0
+}
+
+// StopCoalescing stops coalescing the emits of the event, see
+// CoalesceOnTick, emitting the emit held, if any, before returning. Later
+// emits call the listeners again.
+func (emitter *Emitter) StopCoalescing(event interface{}) *Emitter {
+	emitter.Lock()
 
-type Emitter struct {
-	// Mutex to prevent race conditions within the Emitter.
-	*sync.Mutex
-	// Map of event to a slice of listener function's reflect Values.
-	events     map[interface{}][]reflect.Value
-	ottoEvents map[interface{}][]otto.Value
-	// Optional RecoveryListener to call when a panic occurs.
-	recoverer RecoveryListener
-	// Maximum listeners for debugging potential memory leaks.
-	maxListeners int
-	//
-	ottoVM *otto.Otto
+	var (
+		arguments []interface{}
+		pending   bool
+	)
+
+	if state, ok := emitter.coalescers[event]; ok {
+		close(state.stop)
+		delete(emitter.coalescers, event)
+		arguments, pending = state.take()
+	}
+
+	emitter.Unlock()
+
+	if pending {
+		emitter.emit(emitOptions{flushed: true}, event, arguments)
+	}
+
+	return emitter
 }
 
-// AddListener appends the listener argument to the event arguments slice
-// in the Emitter's events map. If the number of listeners for an event
-// is greater than the Emitter's maximum listeners then a warning is printed.
-// If the relect Value of the listener does not have a Kind of Func then
-// AddListener panics. If a RecoveryListener has been set then it is called
-// recovering from the panic.
-func (emitter *Emitter) AddListener(event, listener interface{}) *Emitter {
+// IsMuted reports whether the event is muted, see Mute.
+func (emitter *Emitter) IsMuted(event interface{}) bool {
 	emitter.Lock()
 	defer emitter.Unlock()
 
-	fn := reflect.ValueOf(listener)
-	ottoFn, isOttoValue := listener.(otto.Value)
+	_, muted := emitter.muted[event]
+	return muted
+}
 
-	if reflect.Func != fn.Kind() && isOttoValue && !ottoFn.IsFunction() {
-		if nil == emitter.recoverer {
-			panic(ErrNoneFunction)
-		} else {
-			emitter.recoverer(event, listener, ErrNoneFunction)
-		}
+// LastEmitted returns the time the event was last emitted, whether or not it
+// had listeners, and whether it has been emitted at all. Monitoring can use
+// it to detect periodic events, such as heartbeats, which stopped arriving.
+// The times are kept, one per event ever emitted, until ResetStats or Reset
+// forgets them, so an Emitter of many short-lived events should call either
+// periodically.
+func (emitter *Emitter) LastEmitted(event interface{}) (time.Time, bool) {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitted, ok := emitter.lastEmitted[event]
+	return emitted, ok
+}
+
+// Stats holds counters of an Emitter's emits, see Stats.
+type Stats struct {
+	// Number of emits, by event, whose arguments could not be converted to
+	// otto Values so that the event's otto listeners were not called.
+	ConversionErrors map[interface{}]uint64
+	// Number of panics of listeners, by event, which were recovered from.
+	Panics map[interface{}]uint64
+	// Number of records of emits, by event, dropped by non-blocking sinks
+	// whose channel was full, see SinkTo.
+	SinkDrops map[interface{}]uint64
+	// Number of failures of listeners, by event, dropped as the channel
+	// returned by Errors was full.
+	ErrorDrops map[interface{}]uint64
+}
+
+// Stats returns a copy of the Emitter's counters, which help tracking down
+// the code emitting arguments its otto listeners cannot receive and the
+// events whose listeners start panicking.
+func (emitter *Emitter) Stats() Stats {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	stats := Stats{
+		ConversionErrors: make(map[interface{}]uint64),
+		Panics:           make(map[interface{}]uint64),
+		SinkDrops:        make(map[interface{}]uint64),
+		ErrorDrops:       make(map[interface{}]uint64),
 	}
 
-	if emitter.maxListeners != -1 && emitter.maxListeners < len(emitter.events[event])+1 {
-		fmt.Fprintf(os.Stdout, "Warning: event `%v` has exceeded the maximum "+
-			"number of listeners of %d.\n", event, emitter.maxListeners)
+	for event, count := range emitter.conversionErrors {
+		stats.ConversionErrors[event] = count
 	}
 
-	if isOttoValue {
-		emitter.ottoEvents[event] = append(emitter.ottoEvents[event], ottoFn)
-	} else {
-		emitter.events[event] = append(emitter.events[event], fn)
+	for event, count := range emitter.panics {
+		stats.Panics[event] = count
+	}
+
+	for event, count := range emitter.sinkDrops {
+		stats.SinkDrops[event] = count
+	}
+
+	for event, count := range emitter.errorDrops {
+		stats.ErrorDrops[event] = count
 	}
 
+	return stats
+}
+
+// ResetStats zeroes the Emitter's counters returned by Stats and forgets the
+// times returned by LastEmitted, leaving the listeners untouched, so that a
+// monitoring loop can report the counters of a window and start the next
+// one. The counters are replaced under the Emitter's mutex, so an Emit
+// counting concurrently is counted either before or after the reset, never
+// partially.
+func (emitter *Emitter) ResetStats() *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.conversionErrors = make(map[interface{}]uint64)
+	emitter.panics = make(map[interface{}]uint64)
+	emitter.sinkDrops = make(map[interface{}]uint64)
+	emitter.errorDrops = make(map[interface{}]uint64)
+	emitter.lastEmitted = make(map[interface{}]time.Time)
 	return emitter
 }
 
-// On is an alias for AddListener.
-func (emitter *Emitter) On(event, listener interface{}) *Emitter {
-	return emitter.AddListener(event, listener)
+// OttoListenerSources returns the JavaScript sources of the event's otto
+// listeners, in the order they were added, as returned by their toString.
+// Native functions, which have no source, are given as NativeSource.
+func (emitter *Emitter) OttoListenerSources(event interface{}) []string {
+	emitter.Lock()
+	listeners := emitter.ottoEvents[event]
+	emitter.Unlock()
+
+	var sources []string
+
+	for _, listener := range listeners {
+		source := listener.ottoFn.String()
+
+		if strings.HasSuffix(source, "{ [native code] }") {
+			source = NativeSource
+		}
+
+		sources = append(sources, source)
+	}
+
+	return sources
 }
 
-func (emitter *Emitter) JsOn(call otto.FunctionCall) otto.Value {
-	event := call.Argument(0)
-	listener := call.Argument(1)
-	e, err := event.Export()
-	if err != nil {
-		return otto.NullValue()
+// OffOttoBySource removes the otto listeners of the event whose JavaScript
+// source, as returned by their toString and OttoListenerSources, is the
+// source, surrounding white space aside. It lets scripting hosts reloading a
+// script detach the listeners its previous run added, which they can no
+// longer reference by value as evaluating the script again creates new
+// function Values. Every listener with the source is removed, so two
+// distinct functions written alike, or the same function added twice, are
+// removed together. Native functions can not be removed by source.
+func (emitter *Emitter) OffOttoBySource(event interface{}, source string) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	listeners, ok := emitter.ottoEvents[event]
+
+	if !ok {
+		return emitter
 	}
-	if event.IsString() {
-		e = e.(string)
+
+	source = strings.TrimSpace(source)
+
+	var remaining []*listener
+
+	for _, listener := range listeners {
+		if source != strings.TrimSpace(listener.ottoFn.String()) {
+			remaining = append(remaining, listener)
+		}
 	}
-	emitter.AddListener(e, listener)
-	v, _ := emitter.ottoVM.ToValue(emitter)
-	return v
+
+	emitter.ottoEvents[event] = remaining
+	return emitter
 }
 
-// RemoveListener removes the listener argument from the event arguments slice
-// in the Emitter's events map.  If the reflect Value of the listener does not
-// have a Kind of Func then RemoveListener panics. If a RecoveryListener has
-// been set then it is called after recovering from the panic.
-func (emitter *Emitter) RemoveListener(event, listener interface{}) *Emitter {
+// ListenerKind is the kind of a listener, see RangeListeners.
+type ListenerKind int
+
+const (
+	// GoListener is the kind of Go function listeners.
+	GoListener ListenerKind = iota
+	// OttoListener is the kind of otto function listeners.
+	OttoListener
+)
+
+// RangeListeners calls fn with the kind and function of each listener of the
+// event, the Go listeners in the order they were added and then the otto
+// listeners, stopping as soon as fn returns false. Go listeners are given as
+// their function and otto listeners as their otto.Value. The Emitter's mutex
+// is held for the whole iteration, so no snapshot is allocated, and fn must
+// therefore not call any method of the Emitter which would deadlock.
+func (emitter *Emitter) RangeListeners(event interface{}, fn func(kind ListenerKind, listener interface{}) bool) {
 	emitter.Lock()
 	defer emitter.Unlock()
 
-	fn := reflect.ValueOf(listener)
-	ottoFn, isOttoValue := listener.(otto.Value)
+	for _, listener := range emitter.events[event] {
+		if !fn(GoListener, listener.fn.Interface()) {
+			return
+		}
+	}
 
-	if reflect.Func != fn.Kind() && isOttoValue && !ottoFn.IsFunction() {
-		if nil == emitter.recoverer {
-			panic(ErrNoneFunction)
-		} else {
-			emitter.recoverer(event, listener, ErrNoneFunction)
+	for _, listener := range emitter.ottoEvents[event] {
+		if !fn(OttoListener, listener.ottoFn) {
+			return
 		}
 	}
+}
 
-	if isOttoValue {
-		if events, ok := emitter.ottoEvents[event]; ok {
-			for i, listener := range events {
-				if ottoFn == listener {
-					// Do not break here to ensure the listener has not been
-					// added more than once.
-					emitter.ottoEvents[event] = append(emitter.ottoEvents[event][:i], emitter.ottoEvents[event][i+1:]...)
-				}
-			}
+// EventSnapshot describes the listeners of an event of an Emitter, see
+// Snapshot. The number of Go and otto listeners of the event are the
+// lengths of Labels and OttoLabels respectively.
+type EventSnapshot struct {
+	// Labels of the Go listeners in the order they were added, which are
+	// the names of the functions as reported by the runtime package unless
+	// the listeners were labelled with OnWithLabel.
+	Labels []string
+	// Labels of the otto listeners in the order they were added, which are
+	// the names of the JavaScript functions or "anonymous".
+	OttoLabels []string
+}
+
+// Snapshot returns a copy of the Emitter's registrations keyed by event,
+// omitting events without listeners. It is intended for tests asserting
+// which listeners are registered, modifying the snapshot has no effect on
+// the Emitter.
+func (emitter *Emitter) Snapshot() map[interface{}]EventSnapshot {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	snapshot := make(map[interface{}]EventSnapshot)
+
+	for event, listeners := range emitter.events {
+		for _, listener := range listeners {
+			s := snapshot[event]
+			s.Labels = append(s.Labels, listener.label)
+			snapshot[event] = s
 		}
-	} else {
-		if events, ok := emitter.events[event]; ok {
-			for i, listener := range events {
-				if fn == listener {
-					// Do not break here to ensure the listener has not been
-					// added more than once.
-					emitter.events[event] = append(emitter.events[event][:i], emitter.events[event][i+1:]...)
+	}
+
+	for event, listeners := range emitter.ottoEvents {
+		for _, listener := range listeners {
+			s := snapshot[event]
+			s.OttoLabels = append(s.OttoLabels, listener.label)
+			snapshot[event] = s
+		}
+	}
+
+	return snapshot
+}
+
+// BeginGroup returns a new Group which becomes the Emitter's active group,
+// tagging every Go and otto listener added to any event of the Emitter
+// until EndGroup is called or another group begins. The listeners of the
+// group can then be removed together with RemoveGroup, for example when
+// disabling the feature which added them.
+func (emitter *Emitter) BeginGroup() *Group {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.group = new(Group)
+	return emitter.group
+}
+
+// EndGroup ends the Emitter's active group, if any, so subsequently added
+// listeners are not tagged.
+func (emitter *Emitter) EndGroup() *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	emitter.group = nil
+	return emitter
+}
+
+// RemoveGroup removes the listeners of the group from every event of the
+// Emitter. A nil group, which listeners added outside of any group belong
+// to, removes nothing.
+func (emitter *Emitter) RemoveGroup(group *Group) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	if nil == group {
+		return emitter
+	}
+
+	for _, events := range []map[interface{}][]*listener{emitter.events, emitter.ottoEvents} {
+		for event, listeners := range events {
+			var remaining []*listener
+
+			for _, listener := range listeners {
+				if group != listener.group {
+					remaining = append(remaining, listener)
 				}
 			}
-		}
 
+			events[event] = remaining
+		}
 	}
 
 	return emitter
 }
 
-// Off is an alias for RemoveListener.
-func (emitter *Emitter) Off(event, listener interface{}) *Emitter {
-	return emitter.RemoveListener(event, listener)
-}
+// SetOttoVMPool sets a pool of size otto VMs, made by the factory, on which
+// Emit calls the otto listeners of an event in parallel, each within its own
+// go routine, instead of one after another on the Emitter's VM. Listeners are
+// still added to, and belong to, the Emitter's VM, they are compiled from
+// their source into each VM of the pool the first time it calls them. This
+// has costs: every listener is compiled once per VM and kept compiled for the
+// lifetime of the pool, every VM converts the arguments again, listeners only
+// see the globals set up by the factory instead of their closures, this is
+// null and native functions cannot be compiled at all. Synchronous emits and
+// EmitReverse keep calling the listeners one after another on the Emitter's
+// VM. If the size is 0 or less, or the factory is nil, the pool is removed.
+func (emitter *Emitter) SetOttoVMPool(size int, factory func() *otto.Otto) *Emitter {
+	var pool *ottoPool
 
-// Once generates a new function which invokes the supplied listener
-// only once before removing itself from the event's listener slice
-// in the Emitter's events map. If the reflect Value of the listener
-// does not have a Kind of Func then Once panics. If a RecoveryListener
-// has been set then it is called after recovering from the panic.
-func (emitter *Emitter) Once(event, listener interface{}) *Emitter {
-	fn := reflect.ValueOf(listener)
-	ottoFn, isOttoValue := listener.(otto.Value)
+	if 0 < size && nil != factory {
+		pool = &ottoPool{vms: make(chan *pooledVM, size)}
 
-	if reflect.Func != fn.Kind() && isOttoValue && !ottoFn.IsFunction() {
-		if nil == emitter.recoverer {
-			panic(ErrNoneFunction)
-		} else {
-			emitter.recoverer(event, listener, ErrNoneFunction)
+		for i := 0; i < size; i++ {
+			pool.vms <- &pooledVM{vm: factory(), compiled: make(map[string]otto.Value)}
 		}
 	}
 
-	var run func(...interface{})
+	emitter.Lock()
+	defer emitter.Unlock()
 
-	if isOttoValue {
-		run = func(arguments ...interface{}) {
-			defer emitter.RemoveListener(event, run)
+	emitter.ottoPool = pool
+	return emitter
+}
 
-			ottoFn.Call(otto.NullValue(), arguments...)
-		}
-	} else {
-		run = func(arguments ...interface{}) {
-			defer emitter.RemoveListener(event, run)
+// SetStrictOttoConversion sets whether an emit whose arguments cannot be
+// converted to otto Values for the otto listeners of the event panics, on the
+// go routine which called it, with an error matching ErrOttoConversion even
+// if a RecoveryListener has been set, for applications treating such emits as
+// programming errors. By default the error is instead supplied, for each of
+// the otto listeners, to the RecoveryListener, to the channel of Errors or to
+// the errors returned by EmitErr, and is only panicked with when none of
+// them is set. Either way the otto listeners are not called while the Go
+// listeners are, and the emit is counted in the ConversionErrors of Stats.
+// The VMs of a pool (see SetOttoVMPool) convert the arguments within each
+// otto listener's go routine, so their failures are never panicked with by
+// strict Emitters, they are supplied as by default.
+func (emitter *Emitter) SetStrictOttoConversion(strict bool) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
 
-			var values []reflect.Value
+	emitter.strictOttoConversion = strict
+	return emitter
+}
 
-			for i := 0; i < len(arguments); i++ {
-				values = append(values, reflect.ValueOf(arguments[i]))
-			}
+// SetOttoValueCache sets a cache of the otto Values of up to size arguments
+// converted for the otto listeners, so that emits repeating the same
+// arguments, such as a hot event emitted with the same status, reuse them
+// instead of converting them again. Only booleans, numbers and strings, and
+// the structs and arrays made of them only, are cached, by value and type,
+// the least recently used being evicted when the cache is full. The otto
+// Value of a struct or array is then shared by the emits of equal arguments,
+// so otto listeners must not assign to its properties. The cached otto
+// Values belong to the Emitter's otto VM, so the cache is emptied when the
+// VM is replaced (see SetOttoVM), and the VMs of a pool convert the
+// arguments without it. If the size is 0 or less, which is the default, the
+// cache is removed.
+func (emitter *Emitter) SetOttoValueCache(size int) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
 
-			fn.Call(values)
-		}
+	emitter.ottoCache = nil
+
+	if 0 < size {
+		emitter.ottoCache = newOttoValueCache(emitter.ottoVM, size)
 	}
 
-	emitter.AddListener(event, run)
 	return emitter
 }
 
-// Emit attempts to use the reflect package to Call each listener stored
-// in the Emitter's events map with the supplied arguments. Each listener
-// is called within its own go routine. The reflect package will panic if
-// the agruments supplied do not align the parameters of a listener function.
-// If a RecoveryListener has been set then it is called after recovering from
-// the panic.
-func (emitter *Emitter) Emit(event interface{}, arguments ...interface{}) *Emitter {
-	var (
-		listeners     []reflect.Value
-		ottoListeners []otto.Value
-		ok            bool
-		ottoOk        bool
-	)
+// SetOttoThis sets the value of this for calls of otto listeners, for
+// listeners written as methods relying on their this. By default this is
+// null.
+func (emitter *Emitter) SetOttoThis(this otto.Value) *Emitter {
+	emitter.Lock()
+	defer emitter.Unlock()
 
-	// Lock the mutex when reading from the Emitter's
-	// events map.
+	emitter.ottoThis = this
+	return emitter
+}
+
+// SetOttoVM sets the otto VM of the Emitter, nil removing it. As otto
+// listeners belong to the VM they were created by, the Emitter's otto
+// listeners are removed, and so are the otto Values cached by
+// SetOttoValueCache, while the this set by SetOttoThis is reset to null.
+// Otto listeners which have yet to be called by an Emit in flight are not
+// called with the new VM, nor are the otto listeners of an Emitter without
+// an otto VM: ErrNoOttoVM is supplied to the RecoveryListener, or panicked
+// with, instead. Arguments which are json.RawMessage are parsed into
+// JavaScript values for the otto listeners, and otto Values are passed to
+// them as is while being exported to Go values for the Go listeners and
+// AnyListeners.
+func (emitter *Emitter) SetOttoVM(vm *otto.Otto) *Emitter {
 	emitter.Lock()
+	defer emitter.Unlock()
 
-	ottoListeners, ottoOk = emitter.ottoEvents[event]
+	emitter.ottoVM = vm
+	emitter.ottoEvents = make(map[interface{}][]*listener)
+	emitter.ottoThis = otto.NullValue()
 
-	if listeners, ok = emitter.events[event]; !ok && !ottoOk {
-		// If the Emitter does not include the event in its
-		// event map, it has no listeners to Call yet.
-		emitter.Unlock()
-		return emitter
+	if nil != emitter.ottoCache {
+		emitter.ottoCache = newOttoValueCache(vm, emitter.ottoCache.capacity)
 	}
 
-	// Unlock the mutex immediately following the read
-	// instead of deferring so that listeners registered
-	// with Once can aquire the mutex for removal.
-	emitter.Unlock()
+	return emitter
+}
+
+// Close closes the Emitter. Subsequent calls to Emit do nothing while adding
+// listeners fails with ErrClosed. Close waits for calls to Emit in flight
+// to return, then removes every listener and the otto VM, so an otto VM can
+// be torn down safely once Close has returned. Close must not be called by
+// a listener, which would wait on itself. See CloseContext to bound the wait.
+func (emitter *Emitter) Close() error {
+	return emitter.CloseContext(context.Background())
+}
 
-	var wg sync.WaitGroup
+// CloseTimeout closes the Emitter like CloseContext, giving up waiting for
+// the calls to Emit in flight once the timeout elapses.
+func (emitter *Emitter) CloseTimeout(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	if ok {
-		wg.Add(len(listeners))
+	return emitter.CloseContext(ctx)
+}
 
-		var values []reflect.Value
+// CloseContext closes the Emitter like Close, but waits for the calls to
+// Emit in flight only until the context is done, so shutdown cannot hang on
+// a stuck listener. If they have not all returned by then, it returns a
+// *CloseError listing the events whose listeners are still running. The
+// shutdown is then partial: the Emitter is closed and its listeners and otto
+// VM are removed as by Close, so the otto listeners which an emit in flight
+// has yet to call are skipped, but the listeners already running are not
+// interrupted and keep running in the background, an otto listener on the
+// otto VM which must therefore not be torn down until WaitIdle returns.
+func (emitter *Emitter) CloseContext(ctx context.Context) error {
+	emitter.Lock()
+	emitter.closed = true
 
-		for i := 0; i < len(arguments); i++ {
-			values = append(values, reflect.ValueOf(arguments[i]))
-		}
+	for event, state := range emitter.coalescers {
+		close(state.stop)
+		delete(emitter.coalescers, event)
+	}
 
-		for _, fn := range listeners {
-			go func(fn reflect.Value) {
-				// Recover from potential panics, supplying them to a
-				// RecoveryListener if one has been set, else allowing
-				// the panic to occur.
-				if nil != emitter.recoverer {
-					defer func() {
-						if r := recover(); nil != r {
-							err := errors.New(fmt.Sprintf("%v", r))
-							emitter.recoverer(event, fn.Interface(), err)
-						}
-					}()
-				}
+	emitter.Unlock()
 
-				defer wg.Done()
+	idle := make(chan struct{})
 
-				fn.Call(values)
-			}(fn)
-		}
+	go func() {
+		defer close(idle)
 
-		wg.Wait()
+		emitter.WaitIdle()
+	}()
+
+	var err error
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
 	}
 
-	if ottoOk {
-		var values []interface{}
+	emitter.Lock()
+	defer emitter.Unlock()
 
-		for i := 0; i < len(arguments); i++ {
-			v, err := emitter.ottoVM.ToValue(arguments[i])
-			if err != nil {
-				fmt.Println(err)
-				return emitter
-			}
-			values = append(values, v)
-		}
+	emitter.events = make(map[interface{}][]*listener)
+	emitter.ottoEvents = make(map[interface{}][]*listener)
+	emitter.ottoVM = nil
+	emitter.ottoCache = nil
 
-		for _, fn := range ottoListeners {
-			if nil != emitter.recoverer {
-				defer func() {
-					if r := recover(); nil != r {
-						err := errors.New(fmt.Sprintf("%v", r))
-						inter, _ := fn.Export()
-						emitter.recoverer(event, inter, err)
-					}
-				}()
-			}
+	if nil == err || 0 == len(emitter.running) {
+		return nil
+	}
 
-			fn.Call(otto.NullValue(), values...)
-		}
+	running := make([]interface{}, 0, len(emitter.running))
+
+	for event := range emitter.running {
+		running = append(running, event)
 	}
-	return emitter
-}
 
-// RecoverWith sets the listener to call when a panic occurs, recovering from
-// panics and attempting to keep the application from crashing.
-func (emitter *Emitter) RecoverWith(listener RecoveryListener) *Emitter {
-	emitter.recoverer = listener
-	return emitter
+	sort.Slice(running, func(i, j int) bool { return lessEvent(running[i], running[j]) })
+	return &CloseError{Events: running, Err: err}
 }
 
-// SetMaxListeners sets the maximum number of listeners per
-// event for the Emitter. If -1 is passed as the maximum,
-// all events may have unlimited listeners. By default, each
-// event can have a maximum number of 10 listeners which is
-// useful for finding memory leaks.
-func (emitter *Emitter) SetMaxListeners(max int) *Emitter {
+// Reset removes every listener of the Emitter, Go, otto and AnyListeners,
+// and its sinks, and forgets the times returned by LastEmitted, while
+// keeping its configuration: the maximum listeners, RecoveryListener, otto
+// VM and every per-event setting such as maximum listeners, concurrency and
+// mutes survive. It suits reusing an Emitter between test cases. Calls to
+// Emit in flight still call the listeners they have read.
+func (emitter *Emitter) Reset() *Emitter {
 	emitter.Lock()
 	defer emitter.Unlock()
 
-	emitter.maxListeners = max
+	emitter.events = make(map[interface{}][]*listener)
+	emitter.ottoEvents = make(map[interface{}][]*listener)
+	emitter.anyListeners = nil
+	emitter.sinks = nil
+	emitter.lastEmitted = make(map[interface{}]time.Time)
 	return emitter
 }
 
@@ -299,27 +4301,103 @@ func (emitter *Emitter) ResetOttoEvents() *Emitter {
 	emitter.Lock()
 	defer emitter.Unlock()
 
-	emitter.ottoEvents = make(map[interface{}][]otto.Value)
+	emitter.ottoEvents = make(map[interface{}][]*listener)
 	return emitter
 }
 
-// NewEmitter returns a new Emitter object, defaulting the
-// number of maximum listeners per event to the DefaultMaxListeners
-// constant and initializing its events map.
-func NewEmitter() (emitter *Emitter) {
+// Option configures an Emitter made by New.
+type Option func(*Emitter)
+
+// WithOttoVM sets the otto VM of the Emitter, see SetOttoVM.
+func WithOttoVM(vm *otto.Otto) Option {
+	return func(emitter *Emitter) {
+		emitter.ottoVM = vm
+	}
+}
+
+// WithMaxListeners sets the maximum number of listeners per event of the
+// Emitter, see SetMaxListeners.
+func WithMaxListeners(max int) Option {
+	return func(emitter *Emitter) {
+		emitter.maxListeners = max
+	}
+}
+
+// WithRecoverer sets the RecoveryListener of the Emitter, see RecoverWith.
+func WithRecoverer(listener RecoveryListener) Option {
+	return func(emitter *Emitter) {
+		emitter.recoverer = listener
+	}
+}
+
+// WithSynchronous makes the Emitter synchronous, see SetSynchronous.
+func WithSynchronous() Option {
+	return func(emitter *Emitter) {
+		emitter.synchronous = true
+	}
+}
+
+// WithWarningWriter sets the writer of the Emitter's warnings, see
+// SetWarningWriter.
+func WithWarningWriter(w io.Writer) Option {
+	return func(emitter *Emitter) {
+		emitter.warnings = w
+	}
+}
+
+// New returns a new Emitter object configured by the options, which are
+// applied in order. Without options the Emitter has no otto VM, at most
+// DefaultMaxListeners listeners per event and writes warnings to stdout.
+func New(options ...Option) (emitter *Emitter) {
 	emitter = new(Emitter)
 	emitter.Mutex = new(sync.Mutex)
-	emitter.events = make(map[interface{}][]reflect.Value)
+	emitter.idle = sync.NewCond(emitter.Mutex)
+	emitter.events = make(map[interface{}][]*listener)
+	emitter.ottoEvents = make(map[interface{}][]*listener)
+	emitter.concurrency = make(map[interface{}]int)
+	emitter.serials = make(map[interface{}]chan struct{})
+	emitter.running = make(map[interface{}]int)
+	emitter.eventMaxListeners = make(map[interface{}]int)
+	emitter.conversionErrors = make(map[interface{}]uint64)
+	emitter.panics = make(map[interface{}]uint64)
+	emitter.sinkDrops = make(map[interface{}]uint64)
+	emitter.errorDrops = make(map[interface{}]uint64)
+	emitter.lastEmitted = make(map[interface{}]time.Time)
+	emitter.muted = make(map[interface{}]*mute)
+	emitter.coalescers = make(map[interface{}]*coalescer)
+	emitter.ottoThis = otto.NullValue()
 	emitter.maxListeners = DefaultMaxListeners
+	emitter.warnings = os.Stdout
+
+	for _, option := range options {
+		option(emitter)
+	}
+
 	return
 }
 
+// NewEmitter returns a new Emitter object, defaulting the
+// number of maximum listeners per event to the DefaultMaxListeners
+// constant and initializing its events map, see New.
+func NewEmitter() (emitter *Emitter) {
+	return New()
+}
+
+// NewEmitterOtto returns a new Emitter object with the otto VM, see New.
 func NewEmitterOtto(vm *otto.Otto) (emitter *Emitter) {
-	emitter = new(Emitter)
-	emitter.Mutex = new(sync.Mutex)
-	emitter.events = make(map[interface{}][]reflect.Value)
-	emitter.ottoEvents = make(map[interface{}][]otto.Value)
-	emitter.ottoVM = vm
-	emitter.maxListeners = DefaultMaxListeners
-	return
+	return New(WithOttoVM(vm))
+}
+
+// NewNamedEmitter returns a new Emitter object like NewEmitter, identified
+// by the name in its warnings and errors.
+func NewNamedEmitter(name string) *Emitter {
+	return NewEmitter().SetName(name)
+}
+
+// NewSynchronousEmitter returns a new Emitter object like NewEmitter whose
+// Emit calls listeners sequentially in the order they were added, see
+// SetSynchronous, making dispatch deterministic and reproducible. Events
+// may still be emitted concurrently with EmitParallel.
+func NewSynchronousEmitter() *Emitter {
+	return NewEmitter().SetSynchronous(true)
 }
@@ -1,7 +1,20 @@
 package emission
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/robertkrimen/otto"
+	"math"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestAddListener(t *testing.T) {
@@ -86,3 +99,2967 @@ func TestRecoveryWith(t *testing.T) {
 		t.Error("Listener supplied to RecoverWith was not called to unset flag on panic.")
 	}
 }
+
+func TestAddListenerRejectsOttoNumber(t *testing.T) {
+	event := "test"
+	flag := true
+	number, _ := otto.New().ToValue(42)
+
+	emitter := NewEmitterOtto(otto.New()).
+		RecoverWith(func(event, listener interface{}, err error) {
+			if ErrNoneFunction == err {
+				flag = !flag
+			}
+		}).
+		AddListener(event, number)
+
+	if flag {
+		t.Error("AddListener failed to reject an otto number with ErrNoneFunction.")
+	}
+
+	if 0 != len(emitter.ottoEvents[event]) {
+		t.Error("AddListener stored an otto number as a listener.")
+	}
+}
+
+func TestAddListenerWithoutOttoVM(t *testing.T) {
+	event := "test"
+	var failure error
+	listener, _ := otto.New().Run("(function () {})")
+
+	emitter := NewEmitter().
+		RecoverWith(func(event, listener interface{}, err error) { failure = err }).
+		AddListener(event, listener)
+
+	if emitter.HasOttoVM() {
+		t.Error("HasOttoVM reported a VM for an Emitter without one.")
+	}
+
+	if ErrNoOttoVM != failure {
+		t.Errorf("AddListener failed with %v instead of ErrNoOttoVM.", failure)
+	}
+}
+
+func TestAddListenerErr(t *testing.T) {
+	event := "test"
+	recovered := false
+
+	emitter := NewEmitter().
+		RecoverWith(func(event, listener interface{}, err error) { recovered = true }).
+		AddListener(event, "not a function")
+
+	if !recovered || 0 != len(emitter.events[event]) {
+		t.Error("AddListener stored an invalid listener with a RecoveryListener set.")
+	}
+
+	recovered = false
+
+	if err := emitter.AddListenerErr(event, 42); ErrNoneFunction != err || recovered {
+		t.Errorf("AddListenerErr returned %v and called the RecoveryListener.", err)
+	}
+
+	if err := emitter.AddListenerErr(event, func() {}); nil != err || 1 != len(emitter.events[event]) {
+		t.Errorf("AddListenerErr failed to add a valid listener with %v.", err)
+	}
+}
+
+func TestEmitWithOttoConversionError(t *testing.T) {
+	event := "test"
+	flag := true
+	vm := otto.New()
+	listener, _ := vm.Run("(function () {})")
+
+	emitter := NewEmitterOtto(vm).
+		RecoverWith(func(event, listener interface{}, err error) {}).
+		AddListener(event, func(c chan int) { flag = !flag }).
+		AddListener(event, listener)
+
+	done := make(chan struct{})
+
+	go func() {
+		// Channels cannot be converted to otto values.
+		emitter.Emit(event, make(chan int))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Emit blocked after failing to convert an argument for otto.")
+	}
+
+	if flag {
+		t.Error("Emit failed to call the Go listener when otto conversion failed.")
+	}
+}
+
+func TestStatsConversionErrors(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	listener, _ := vm.Run("(function () {})")
+
+	emitter := NewEmitterOtto(vm).
+		RecoverWith(func(event, listener interface{}, err error) {}).
+		AddListener(event, listener).
+		Emit(event, make(chan int)).
+		Emit(event, make(chan int)).
+		Emit(event, 1)
+
+	if count := emitter.Stats().ConversionErrors[event]; 2 != count {
+		t.Errorf("Stats counted %d conversion errors instead of 2.", count)
+	}
+}
+
+func TestStrictOttoConversion(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	listener, _ := vm.Run("(function () {})")
+	var failure error
+
+	emitter := NewEmitterOtto(vm).
+		RecoverWith(func(event, listener interface{}, err error) { failure = err }).
+		AddListener(event, listener).
+		Emit(event, make(chan int))
+
+	if !errors.Is(failure, ErrOttoConversion) {
+		t.Errorf("RecoveryListener received %v instead of ErrOttoConversion.", failure)
+	}
+
+	defer func() {
+		if r, ok := recover().(error); !ok || !errors.Is(r, ErrOttoConversion) {
+			t.Errorf("Strict emit panicked with %v instead of ErrOttoConversion.", r)
+		}
+	}()
+
+	emitter.SetStrictOttoConversion(true).Emit(event, make(chan int))
+}
+
+func TestEmitSkipsOttoConversionForGoListeners(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	listener, _ := vm.Run("(function () {})")
+	invoked := false
+
+	// Converting a channel fails, so any conversion attempt is counted.
+	emitter := NewEmitterOtto(vm).
+		AddListener(event, func(ch chan int) { invoked = true }).
+		AddListener("otto", listener).
+		Emit(event, make(chan int))
+
+	if !invoked || 0 != emitter.Stats().ConversionErrors[event] {
+		t.Error("Emit converted the arguments of an event without otto listeners.")
+	}
+}
+
+func TestEmitJSONToOtto(t *testing.T) {
+	event := "test"
+	var name string
+	var count int64
+
+	vm := otto.New()
+	vm.Set("record", func(call otto.FunctionCall) otto.Value {
+		name = call.Argument(0).String()
+		count, _ = call.Argument(1).ToInteger()
+		return otto.UndefinedValue()
+	})
+
+	listener, _ := vm.Run("(function (payload) { record(payload.user.name, payload.user.tags.length); })")
+
+	NewEmitterOtto(vm).
+		AddListener(event, listener).
+		Emit(event, json.RawMessage(`{"user": {"name": "otto", "tags": ["a", "b"]}}`))
+
+	if "otto" != name || 2 != count {
+		t.Errorf("Otto listener received the JSON as %s with %d tags.", name, count)
+	}
+}
+
+func TestStatsPanics(t *testing.T) {
+	emitter := NewEmitter().
+		RecoverWith(func(event, listener interface{}, err error) {}).
+		AddListener("flaky", func() { panic("failed") }).
+		AddListener("stable", func() {}).
+		Emit("flaky").
+		Emit("flaky").
+		Emit("stable")
+
+	if panics := emitter.Stats().Panics; 2 != panics["flaky"] || 0 != panics["stable"] {
+		t.Errorf("Stats counted the panics %v.", panics)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	emitter := NewEmitter().
+		RecoverWith(func(event, listener interface{}, err error) {}).
+		AddListener("flaky", func() { panic("failed") }).
+		Emit("flaky").
+		ResetStats()
+
+	if panics := emitter.Stats().Panics; 0 != len(panics) {
+		t.Errorf("ResetStats kept the panics %v.", panics)
+	}
+
+	if _, ok := emitter.LastEmitted("flaky"); ok {
+		t.Error("ResetStats kept the time of the last emit.")
+	}
+
+	if 1 != emitter.ListenerCount("flaky") {
+		t.Error("ResetStats removed the listener.")
+	}
+
+	if emitter.Emit("flaky"); 1 != emitter.Stats().Panics["flaky"] {
+		t.Error("ResetStats stopped the panics from being counted.")
+	}
+}
+
+func TestSetSynchronous(t *testing.T) {
+	event := "test"
+	var order []int
+
+	NewEmitter().
+		SetSynchronous(true).
+		AddListener(event, func() { order = append(order, 1) }).
+		AddListener(event, func() { order = append(order, 2) }).
+		AddListener(event, func() { order = append(order, 3) }).
+		Emit(event)
+
+	if 3 != len(order) || 1 != order[0] || 2 != order[1] || 3 != order[2] {
+		t.Errorf("Synchronous Emit called listeners out of order: %v.", order)
+	}
+}
+
+func TestEmitOverlapsGoAndOttoListeners(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	release := make(chan struct{})
+
+	// The Go listener only returns once the otto listener has been called.
+	vm.Set("release", func() { close(release) })
+	listener, _ := vm.Run("(function () { release(); })")
+
+	emitter := NewEmitterOtto(vm).
+		AddListener(event, func() { <-release }).
+		AddListener(event, listener)
+
+	done := make(chan struct{})
+
+	go func() {
+		emitter.Emit(event)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Emit waited on Go listeners before calling otto listeners.")
+	}
+}
+
+func TestEmitOttoValue(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	listener, _ := vm.Run("var received; (function (payload) { received = payload; })")
+	payload, _ := vm.Run("({name: 'otto'})")
+	var exported interface{}
+
+	NewEmitterOtto(vm).
+		SetSynchronous(true).
+		AddListener(event, listener).
+		AddListener(event, func(payload interface{}) { exported = payload }).
+		Emit(event, payload)
+
+	vm.Set("payload", payload)
+
+	if same, _ := vm.Run("received === payload"); "true" != same.String() {
+		t.Error("Otto listener received a converted copy of the otto Value.")
+	}
+
+	if object, ok := exported.(map[string]interface{}); !ok || "otto" != object["name"] {
+		t.Errorf("Go listener received %v instead of the exported otto Value.", exported)
+	}
+}
+
+func TestEmitValues(t *testing.T) {
+	event := "test"
+	var received, raw []interface{}
+
+	NewSynchronousEmitter().
+		AddListener(event, func(i int, s string) { received = append(received, i, s) }).
+		OnRaw(event, func(arguments ...interface{}) { raw = arguments }).
+		EmitValues(event, []reflect.Value{reflect.ValueOf(1), reflect.ValueOf("a")})
+
+	if 2 != len(received) || 1 != received[0] || "a" != received[1] {
+		t.Errorf("Go listener received %v instead of the values.", received)
+	}
+
+	if 2 != len(raw) || 1 != raw[0] || "a" != raw[1] {
+		t.Errorf("Raw listener received %v instead of the values.", raw)
+	}
+}
+
+func TestEmitNamed(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	listener, _ := vm.Run("var received; (function (id, options) { received = id + ':' + options.verbose + ':' + Object.keys(options).join(); })")
+	var named map[string]interface{}
+
+	NewEmitterOtto(vm).
+		SetSynchronous(true).
+		AddListener(event, listener).
+		AddListener(event, func(id int, options map[string]interface{}) { named = options }).
+		EmitNamed(event, map[string]interface{}{"verbose": true, "level": 2}, 7)
+
+	if received, _ := vm.Get("received"); "7:true:level,verbose" != received.String() {
+		t.Errorf("Otto listener received %v instead of the positional and named arguments.", received)
+	}
+
+	if true != named["verbose"] || 2 != named["level"] {
+		t.Errorf("Go listener received the named arguments %v.", named)
+	}
+}
+
+func TestOnceWithOttoListener(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	listener, _ := vm.Run("var count = 0; (function (n) { count += n; })")
+
+	emitter := NewEmitterOtto(vm).
+		Once(event, listener).
+		Emit(event, 1).
+		Emit(event, 1)
+
+	if count, _ := vm.Get("count"); "1" != count.String() {
+		t.Errorf("Once called the otto listener %v times.", count)
+	}
+
+	if 0 != len(emitter.ottoEvents[event]) {
+		t.Error("Once failed to remove the otto listener.")
+	}
+}
+
+func TestSetEventConcurrency(t *testing.T) {
+	event := "test"
+	var active, peak int32
+
+	listener := func() {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	emitter := NewEmitter().SetEventConcurrency(event, 2)
+
+	for i := 0; i < 6; i++ {
+		emitter.AddListener(event, listener)
+	}
+
+	emitter.Emit(event)
+
+	if 2 != peak {
+		t.Errorf("Emit called %d listeners at once instead of 2.", peak)
+	}
+}
+
+func TestSetSerialPerEvent(t *testing.T) {
+	var active, peak, eventPeak int32
+	var eventActive [2]int32
+
+	enter := func(counter, max *int32) {
+		n := atomic.AddInt32(counter, 1)
+
+		for {
+			p := atomic.LoadInt32(max)
+			if n <= p || atomic.CompareAndSwapInt32(max, p, n) {
+				break
+			}
+		}
+	}
+
+	events := []string{"first", "second"}
+	emitter := NewEmitter().SetSerialPerEvent(true)
+
+	for i, event := range events {
+		counter := &eventActive[i]
+
+		for j := 0; j < 2; j++ {
+			emitter.AddListener(event, func() {
+				enter(counter, &eventPeak)
+				defer atomic.AddInt32(counter, -1)
+				enter(&active, &peak)
+				defer atomic.AddInt32(&active, -1)
+
+				time.Sleep(10 * time.Millisecond)
+			})
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		for _, event := range events {
+			wg.Add(1)
+
+			go func(event string) {
+				defer wg.Done()
+				emitter.Emit(event)
+			}(event)
+		}
+	}
+
+	wg.Wait()
+
+	if 1 != eventPeak {
+		t.Errorf("Listeners of an event ran %d at once instead of one at a time.", eventPeak)
+	}
+
+	if 2 != peak {
+		t.Errorf("Listeners of different events ran %d at once instead of 2.", peak)
+	}
+
+	if 0 != len(emitter.serials) {
+		t.Errorf("Emitter kept %d serializing channels once no emit was in flight.", len(emitter.serials))
+	}
+}
+
+func TestOnWithWeight(t *testing.T) {
+	event := "test"
+	var held, peak int32
+
+	listener := func(weight int32) func() {
+		return func() {
+			n := atomic.AddInt32(&held, weight)
+			defer atomic.AddInt32(&held, -weight)
+
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	emitter := NewEmitter().SetEventConcurrency(event, 3)
+
+	for i := 0; i < 3; i++ {
+		emitter.OnWithWeight(event, listener(2), 2)
+		emitter.AddListener(event, listener(1))
+	}
+
+	emitter.OnWithWeight(event, listener(3), 5)
+	emitter.Emit(event)
+
+	if 3 < peak {
+		t.Errorf("Emit called listeners weighing %d at once instead of at most 3.", peak)
+	}
+}
+
+func TestEmitPanicWithoutRecoverer(t *testing.T) {
+	event := "test"
+	value := errors.New("listener panicked")
+	var called int32
+
+	emitter := NewEmitter().
+		On(event, func() { panic(value) }).
+		On(event, func() {
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&called, 1)
+		})
+
+	defer func() {
+		if r := recover(); value != r {
+			t.Errorf("Emit panicked with %v instead of the listener's panic.", r)
+		}
+
+		if 1 != atomic.LoadInt32(&called) {
+			t.Error("Emit panicked before the other listener returned.")
+		}
+	}()
+
+	emitter.Emit(event)
+}
+
+func TestOnRaw(t *testing.T) {
+	event := "test"
+	var received []interface{}
+
+	NewEmitter().
+		OnRaw(event, func(arguments ...interface{}) { received = arguments }).
+		Emit(event, 1, "two")
+
+	if 2 != len(received) || 1 != received[0] || "two" != received[1] {
+		t.Errorf("Raw listener received %v instead of the emitted arguments.", received)
+	}
+}
+
+func TestEventMaxListeners(t *testing.T) {
+	event := "test"
+
+	emitter := NewEmitter().
+		SetMaxListeners(5).
+		SetEventMaxListeners(event, 2)
+
+	if 5 != emitter.MaxListeners() {
+		t.Errorf("MaxListeners returned %d instead of 5.", emitter.MaxListeners())
+	}
+
+	if 2 != emitter.EventMaxListeners(event) {
+		t.Errorf("EventMaxListeners returned %d instead of the override of 2.", emitter.EventMaxListeners(event))
+	}
+
+	if 5 != emitter.EventMaxListeners("other") {
+		t.Errorf("EventMaxListeners returned %d instead of the default of 5.", emitter.EventMaxListeners("other"))
+	}
+}
+
+func TestEmitMap(t *testing.T) {
+	event := "test"
+	var name interface{}
+	vm := otto.New()
+	listener, _ := vm.Run("var js; (function (payload) { js = payload.name; })")
+
+	NewEmitterOtto(vm).
+		OnMap(event, func(payload map[string]interface{}) { name = payload["name"] }).
+		AddListener(event, listener).
+		EmitMap(event, map[string]interface{}{"name": "emission"})
+
+	if "emission" != name {
+		t.Errorf("Map listener received %v instead of the payload's name.", name)
+	}
+
+	if js, _ := vm.Get("js"); "emission" != js.String() {
+		t.Errorf("Otto listener received %v instead of the payload's name.", js)
+	}
+}
+
+func TestSetPanicFormatter(t *testing.T) {
+	event := "test"
+	formatted := errors.New("formatted")
+	var failure error
+
+	NewEmitter().
+		AddListener(event, func() { panic(event) }).
+		SetPanicFormatter(func(r interface{}) error { return formatted }).
+		RecoverWith(func(event, listener interface{}, err error) { failure = err }).
+		Emit(event)
+
+	if formatted != failure {
+		t.Errorf("RecoveryListener received %v instead of the formatted panic.", failure)
+	}
+}
+
+func TestWaitIdle(t *testing.T) {
+	event := "test"
+	started := make(chan struct{})
+	var finished int32
+
+	emitter := NewEmitter().
+		AddListener(event, func() {
+			close(started)
+			time.Sleep(10 * time.Millisecond)
+			atomic.StoreInt32(&finished, 1)
+		})
+
+	go emitter.Emit(event)
+
+	<-started
+	emitter.WaitIdle()
+
+	if 1 != atomic.LoadInt32(&finished) {
+		t.Error("WaitIdle returned before the listener finished.")
+	}
+}
+
+func TestNamedEmitter(t *testing.T) {
+	event := "test"
+	var failure error
+
+	NewNamedEmitter("named").
+		RecoverWith(func(event, listener interface{}, err error) { failure = err }).
+		AddListener(event, "not a function")
+
+	if !errors.Is(failure, ErrNoneFunction) {
+		t.Errorf("RecoveryListener received %v instead of ErrNoneFunction.", failure)
+	}
+
+	if !strings.Contains(failure.Error(), "named") {
+		t.Errorf("Error %q does not name the emitter.", failure)
+	}
+}
+
+func TestEmitDeadline(t *testing.T) {
+	event := "test"
+	release := make(chan struct{})
+
+	emitter := NewEmitter().
+		AddListener(event, func() { <-release })
+
+	if err := emitter.EmitDeadline(time.Now().Add(10*time.Millisecond), event); ErrDeadlineExceeded != err {
+		t.Errorf("EmitDeadline returned %v instead of ErrDeadlineExceeded.", err)
+	}
+
+	close(release)
+	emitter.WaitIdle()
+
+	if err := emitter.EmitDeadline(time.Now().Add(time.Second), event); nil != err {
+		t.Errorf("EmitDeadline returned %v for listeners returning in time.", err)
+	}
+}
+
+func TestOnWithUnsub(t *testing.T) {
+	event := "test"
+	invoked := 0
+
+	// Only the registration called first removes itself.
+	listener := func(unsubscribe func()) {
+		if invoked = invoked + 1; 1 == invoked {
+			unsubscribe()
+		}
+	}
+
+	emitter := NewEmitter().
+		SetSynchronous(true).
+		OnWithUnsub(event, listener).
+		OnWithUnsub(event, listener).
+		Emit(event).
+		Emit(event)
+
+	if 3 != invoked {
+		t.Errorf("Listeners were called %d times instead of 3.", invoked)
+	}
+
+	if 1 != len(emitter.events[event]) {
+		t.Error("Unsubscribe failed to remove exactly its own registration.")
+	}
+}
+
+func TestOnWithEmitter(t *testing.T) {
+	var followed string
+	var failure error
+
+	emitter := NewSynchronousEmitter().
+		RecoverWith(func(event, listener interface{}, err error) { failure = err }).
+		OnWithEmitter("request", func(emitter *Emitter, path string) { emitter.Emit("logged", path) }).
+		OnWithEmitter("logged", func(emitter EventEmitter, path string) { followed = path }).
+		OnWithEmitter("invalid", func(path string) {})
+
+	emitter.Emit("request", "/index")
+
+	if "/index" != followed {
+		t.Errorf("Listener supplied the Emitter emitted %q instead of the path.", followed)
+	}
+
+	if ErrNoneEmitter != failure || 0 != emitter.ListenerCount("invalid") {
+		t.Errorf("OnWithEmitter failed with %v on a listener without an Emitter parameter.", failure)
+	}
+}
+
+func TestEmitReverse(t *testing.T) {
+	event := "test"
+	var order []int
+
+	NewEmitter().
+		AddListener(event, func() { order = append(order, 1) }).
+		AddListener(event, func() { order = append(order, 2) }).
+		AddListener(event, func() { order = append(order, 3) }).
+		EmitReverse(event)
+
+	if 3 != len(order) || 3 != order[0] || 2 != order[1] || 1 != order[2] {
+		t.Errorf("EmitReverse called listeners out of reverse order: %v.", order)
+	}
+}
+
+func TestSetOttoThis(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	this, _ := vm.Run("var received; ({ name: 'plugin' })")
+	listener, _ := vm.Run("(function () { received = this.name; })")
+
+	emitter := NewEmitterOtto(vm).
+		SetOttoThis(this).
+		AddListener(event, listener).
+		Emit(event)
+
+	if received, _ := vm.Get("received"); "plugin" != received.String() {
+		t.Errorf("Otto listener was called with this.name of %v.", received)
+	}
+
+	if !emitter.SetOttoVM(otto.New()).ottoThis.IsNull() {
+		t.Error("SetOttoVM kept the this of the replaced VM.")
+	}
+}
+
+func TestSetOttoValueCache(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	listener, _ := vm.Run("var received = []; (function (value) { received.push(value); })")
+
+	emitter := NewEmitterOtto(vm).
+		SetOttoValueCache(2).
+		AddListener(event, listener).
+		Emit(event, "a").
+		Emit(event, "a").
+		Emit(event, "b").
+		Emit(event, 1).
+		Emit(event, struct{ name string }{"c"})
+
+	if received, _ := vm.Run("received.slice(0, 4).join()"); "a,a,b,1" != received.String() {
+		t.Errorf("Otto listener received %v with cached values.", received)
+	}
+
+	if cached := emitter.ottoCache.order.Len(); 2 != cached {
+		t.Errorf("Cache holds %d otto Values instead of its size of 2.", cached)
+	}
+
+	if _, ok := emitter.ottoCache.get("a"); ok {
+		t.Error("Cache kept the least recently used otto Value.")
+	}
+
+	if _, ok := emitter.ottoCache.get(struct{ name string }{"c"}); !ok {
+		t.Error("Cache did not keep the otto Value of a plain struct.")
+	}
+
+	if isCacheable(struct{ names []string }{}) || isCacheable(&struct{ name string }{}) {
+		t.Error("Arguments holding references were reported as cacheable.")
+	}
+
+	if isCacheable(math.NaN()) || isCacheable([1]float64{math.NaN()}) {
+		t.Error("Arguments holding NaN were reported as cacheable.")
+	}
+
+	emitter.SetOttoVM(otto.New())
+
+	if cached := emitter.ottoCache.order.Len(); 0 != cached {
+		t.Errorf("Cache kept %d otto Values of the replaced VM.", cached)
+	}
+}
+
+func TestSetOttoVMDuringEmit(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	var failure error
+	var emitter *Emitter
+
+	vm.Set("detach", func() { emitter.SetOttoVM(nil) })
+	first, _ := vm.Run("var called = false; (function () { detach(); })")
+	second, _ := vm.Run("(function () { called = true; })")
+
+	emitter = NewEmitterOtto(vm).
+		RecoverWith(func(event, listener interface{}, err error) { failure = err }).
+		AddListener(event, first).
+		AddListener(event, second)
+
+	emitter.Emit(event)
+
+	if called, _ := vm.Get("called"); "false" != called.String() {
+		t.Error("Emit called an otto listener after the VM was removed.")
+	}
+
+	if ErrNoOttoVM != failure {
+		t.Errorf("RecoveryListener received %v instead of ErrNoOttoVM.", failure)
+	}
+}
+
+func TestClose(t *testing.T) {
+	event := "test"
+	flag := true
+
+	emitter := NewEmitter().
+		AddListener(event, func() { flag = !flag })
+
+	emitter.Close()
+	emitter.Emit(event)
+
+	if !flag {
+		t.Error("Emit called a listener of a closed Emitter.")
+	}
+
+	if 0 != len(emitter.events[event]) {
+		t.Error("Close failed to remove the listeners.")
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	emitter := NewEmitter().
+		AddListener("stuck", func() {
+			close(started)
+			<-release
+		}).
+		AddListener("quick", func() {})
+
+	done := emitter.EmitNotify("stuck")
+	<-started
+	emitter.Emit("quick")
+
+	err := emitter.CloseTimeout(10 * time.Millisecond)
+	closeErr, ok := err.(*CloseError)
+
+	if !ok || 1 != len(closeErr.Events) || "stuck" != closeErr.Events[0] || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("CloseTimeout returned %v instead of the event still running.", err)
+	}
+
+	if 0 != emitter.ListenerCount("quick") {
+		t.Error("CloseTimeout failed to remove the listeners.")
+	}
+
+	close(release)
+	<-done
+
+	if err := emitter.CloseTimeout(10 * time.Millisecond); nil != err {
+		t.Errorf("CloseTimeout returned %v without listeners running.", err)
+	}
+}
+
+func TestSetUnhandledHandler(t *testing.T) {
+	event := "test"
+	var unhandled interface{}
+
+	NewEmitter().
+		SetUnhandledHandler(func(event interface{}, arguments ...interface{}) { unhandled = event }).
+		AddListener("other", func() {}).
+		Emit("other").
+		Emit(event)
+
+	if event != unhandled {
+		t.Errorf("Unhandled handler was called for %v instead of %v.", unhandled, event)
+	}
+}
+
+func TestSetRegistrationGuard(t *testing.T) {
+	refused := errors.New("refused")
+	var failed []error
+
+	emitter := NewEmitter().
+		RecoverWith(func(event, listener interface{}, err error) { failed = append(failed, err) }).
+		SetRegistrationGuard(func(event, listener interface{}) error {
+			if "private" == event {
+				return refused
+			}
+
+			return nil
+		}).
+		On("public", func() {}).
+		On("private", func() {}).
+		Once("private", func() {})
+
+	if 1 != emitter.ListenerCount("public") || 0 != emitter.ListenerCount("private") {
+		t.Error("Registration guard let the wrong listeners be added.")
+	}
+
+	if 2 != len(failed) || refused != failed[0] || refused != failed[1] {
+		t.Errorf("Refused registrations failed with %v instead of the guard's error.", failed)
+	}
+}
+
+func TestSetErrorEvent(t *testing.T) {
+	emitted := errors.New("failed")
+	emitter := NewEmitter().SetErrorEvent("error")
+
+	if errs := emitter.EmitErr("error", emitted); 1 != len(errs) || emitted != errs[0] {
+		t.Errorf("Emitting the error event without listeners failed with %v instead of the emitted error.", errs)
+	}
+
+	if errs := emitter.EmitErr("error"); 1 != len(errs) || ErrUnhandledErrorEvent != errs[0] {
+		t.Errorf("Emitting the error event without an error failed with %v instead of ErrUnhandledErrorEvent.", errs)
+	}
+
+	if errs := emitter.On("error", func(error) {}).EmitErr("error", emitted); 0 != len(errs) {
+		t.Errorf("Emitting the error event with a listener failed with %v.", errs)
+	}
+
+	defer func() {
+		if r := recover(); emitted != r {
+			t.Errorf("Emitting the error event without a RecoveryListener panicked with %v.", r)
+		}
+	}()
+
+	emitter.SetErrorEvent("other").Emit("other", emitted)
+}
+
+func TestSetEmitSequence(t *testing.T) {
+	var sequences []int64
+	var metadata EmitMetadata
+
+	NewSynchronousEmitter().
+		SetEmitSequence(true).
+		On("numbered", func(sequence int64, name string) { sequences = append(sequences, sequence) }).
+		On("described", func(ctx context.Context, emitted EmitMetadata) { metadata = emitted }).
+		Emit("numbered", "first").
+		Emit("described").
+		Emit("numbered", "second")
+
+	if 2 != len(sequences) || 1 != sequences[0] || 3 != sequences[1] {
+		t.Errorf("Listener received the sequence numbers %v instead of 1 and 3.", sequences)
+	}
+
+	if 2 != metadata.Sequence || "described" != metadata.Event {
+		t.Errorf("Listener received the metadata %v.", metadata)
+	}
+}
+
+func TestOttoFunction(t *testing.T) {
+	event := "test"
+	var received []string
+
+	vm := otto.New()
+	fn, err := OttoFunction(vm, func(name string) { received = append(received, name) })
+
+	if nil != err {
+		t.Fatalf("OttoFunction failed with %v.", err)
+	}
+
+	NewEmitterOtto(vm).
+		SetSynchronous(true).
+		AddListener(event, fn).
+		Emit(event, "otto")
+
+	if 1 != len(received) || "otto" != received[0] {
+		t.Errorf("Wrapped Go function received %v.", received)
+	}
+
+	if _, err := OttoFunction(vm, 42); ErrNoneFunction != err {
+		t.Errorf("OttoFunction failed with %v instead of ErrNoneFunction.", err)
+	}
+}
+
+func TestGoFunction(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	listener, _ := vm.Run("var names = []; (function (payload) { if (!payload) { throw new Error('missing'); } names.push(payload.name); })")
+	fn, err := GoFunction(vm, listener)
+
+	if nil != err {
+		t.Fatalf("GoFunction failed with %v.", err)
+	}
+
+	errs := NewSynchronousEmitter().
+		AddListener(event, fn).
+		Emit(event, json.RawMessage(`{"name": "go"}`)).
+		EmitErr(event, nil)
+
+	if names, _ := vm.Run("names.join()"); "go" != names.String() {
+		t.Errorf("Wrapped otto function received the names %v.", names)
+	}
+
+	if 1 != len(errs) {
+		t.Errorf("Wrapped otto function failed with %v instead of the thrown error.", errs)
+	}
+
+	if _, err := GoFunction(vm, otto.UndefinedValue()); ErrNoneFunction != err {
+		t.Errorf("GoFunction failed with %v instead of ErrNoneFunction.", err)
+	}
+}
+
+func TestRemoveGroup(t *testing.T) {
+	vm := otto.New()
+	listener, _ := vm.Run("(function () {})")
+	emitter := NewEmitterOtto(vm).
+		AddListener("kept", func() {})
+
+	group := emitter.BeginGroup()
+
+	emitter.
+		AddListener("kept", func() {}).
+		AddListener("removed", func() {}).
+		AddListener("removed", listener).
+		EndGroup().
+		AddListener("removed", func() {}).
+		RemoveGroup(group)
+
+	if 1 != len(emitter.events["kept"]) || 1 != len(emitter.events["removed"]) {
+		t.Error("RemoveGroup failed to remove exactly the group's Go listeners.")
+	}
+
+	if 0 != len(emitter.ottoEvents["removed"]) {
+		t.Error("RemoveGroup failed to remove the group's otto listeners.")
+	}
+
+	if emitter.RemoveGroup(nil); 1 != len(emitter.events["kept"]) || 1 != len(emitter.events["removed"]) {
+		t.Error("RemoveGroup removed the listeners outside of any group for a nil group.")
+	}
+}
+
+func TestEmitParallel(t *testing.T) {
+	event := "test"
+	release := make(chan struct{})
+
+	// The first listener only returns once the second has been called,
+	// which requires them to be called concurrently.
+	emitter := NewSynchronousEmitter().
+		AddListener(event, func() { <-release }).
+		AddListener(event, func() { close(release) })
+
+	done := make(chan struct{})
+
+	go func() {
+		emitter.EmitParallel(event)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("EmitParallel called the listeners of a synchronous Emitter sequentially.")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	listener, _ := vm.Run("(function named() {})")
+
+	removed := func() {}
+
+	snapshot := NewEmitterOtto(vm).
+		AddListener(event, TestSnapshot).
+		AddListener(event, listener).
+		AddListener("empty", removed).
+		RemoveListener("empty", removed).
+		Snapshot()
+
+	if _, ok := snapshot["empty"]; ok {
+		t.Error("Snapshot included an event without listeners.")
+	}
+
+	s := snapshot[event]
+
+	if 1 != len(s.Labels) || !strings.HasSuffix(s.Labels[0], ".TestSnapshot") {
+		t.Errorf("Snapshot reported Go labels %v.", s.Labels)
+	}
+
+	if 1 != len(s.OttoLabels) || "named" != s.OttoLabels[0] {
+		t.Errorf("Snapshot reported otto labels %v.", s.OttoLabels)
+	}
+}
+
+func TestOnceWithConcurrentEmits(t *testing.T) {
+	event := "test"
+	var invoked int32
+	var wg sync.WaitGroup
+
+	emitter := NewEmitter().
+		Once(event, func() { atomic.AddInt32(&invoked, 1) })
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			emitter.Emit(event)
+		}()
+	}
+
+	wg.Wait()
+
+	if 1 != invoked {
+		t.Errorf("Concurrent emits called a Once listener %d times.", invoked)
+	}
+}
+
+// orderedListeners adds count numbered listeners of the event to the
+// emitter, returning a function reporting the order they have been called.
+func orderedListeners(emitter *Emitter, event interface{}, count int) func() []int {
+	var mu sync.Mutex
+	var order []int
+
+	for i := 0; i < count; i++ {
+		i := i
+
+		emitter.AddListener(event, func() {
+			mu.Lock()
+			defer mu.Unlock()
+
+			order = append(order, i)
+		})
+	}
+
+	return func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]int(nil), order...)
+	}
+}
+
+func TestEmitOrdering(t *testing.T) {
+	event := "test"
+	count := 8
+
+	emitters := map[string]func(*Emitter){
+		"EmitSync":    func(emitter *Emitter) { emitter.EmitSync(event) },
+		"EmitReverse": func(emitter *Emitter) { emitter.EmitReverse(event) },
+		"synchronous Emit": func(emitter *Emitter) {
+			emitter.SetSynchronous(true).Emit(event)
+		},
+		"Emit":         func(emitter *Emitter) { emitter.Emit(event) },
+		"EmitParallel": func(emitter *Emitter) { emitter.EmitParallel(event) },
+	}
+
+	for name, emit := range emitters {
+		emitter := NewEmitter().SetMaxListeners(-1)
+		order := orderedListeners(emitter, event, count)
+
+		emit(emitter)
+
+		called := order()
+
+		if count != len(called) {
+			t.Errorf("%s called %d of %d listeners.", name, len(called), count)
+			continue
+		}
+
+		seen := make(map[int]bool)
+
+		for _, i := range called {
+			seen[i] = true
+		}
+
+		if count != len(seen) {
+			t.Errorf("%s called listeners more than once: %v.", name, called)
+			continue
+		}
+
+		for position, i := range called {
+			expected := position
+
+			switch name {
+			case "EmitReverse":
+				expected = count - 1 - position
+			case "Emit", "EmitParallel":
+				// Concurrent listeners are called in an unspecified order.
+				expected = i
+			}
+
+			if expected != i {
+				t.Errorf("%s called listeners in the order %v.", name, called)
+				break
+			}
+		}
+	}
+}
+
+func TestEmitOrderingWithOttoListeners(t *testing.T) {
+	event := "test"
+	var mu sync.Mutex
+	var order []string
+
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		order = append(order, name)
+	}
+
+	vm := otto.New()
+	vm.Set("record", func(call otto.FunctionCall) otto.Value {
+		record(call.Argument(0).String())
+		return otto.UndefinedValue()
+	})
+
+	jsFn := func(name string) otto.Value {
+		fn, _ := vm.Run("(function() { record('" + name + "'); })")
+		return fn
+	}
+
+	emitter := NewEmitterOtto(vm).
+		AddListener(event, jsFn("otto 1")).
+		AddListener(event, func() { record("go 1") }).
+		AddListener(event, jsFn("otto 2")).
+		AddListener(event, func() { record("go 2") })
+
+	emitter.EmitSync(event)
+
+	if expected, actual := "go 1,go 2,otto 1,otto 2", strings.Join(order, ","); expected != actual {
+		t.Errorf("EmitSync called listeners in the order %s.", actual)
+	}
+
+	order = nil
+	emitter.EmitReverse(event)
+
+	if expected, actual := "otto 2,otto 1,go 2,go 1", strings.Join(order, ","); expected != actual {
+		t.Errorf("EmitReverse called listeners in the order %s.", actual)
+	}
+
+	order = nil
+	emitter.Emit(event)
+
+	var ottoOrder []string
+
+	for _, name := range order {
+		if strings.HasPrefix(name, "otto") {
+			ottoOrder = append(ottoOrder, name)
+		}
+	}
+
+	if expected, actual := "otto 1,otto 2", strings.Join(ottoOrder, ","); expected != actual {
+		t.Errorf("Emit called otto listeners in the order %s.", actual)
+	}
+}
+
+func TestEmitSyncPanicIsolation(t *testing.T) {
+	event := "test"
+	var called []int
+	var recovered []error
+
+	NewEmitter().
+		RecoverWith(func(event, listener interface{}, err error) { recovered = append(recovered, err) }).
+		AddListener(event, func() { called = append(called, 1) }).
+		AddListener(event, func() { panic("failed") }).
+		AddListener(event, func() { called = append(called, 3) }).
+		EmitSync(event)
+
+	if 2 != len(called) || 1 != called[0] || 3 != called[1] {
+		t.Errorf("EmitSync called the listeners %v around the panicking one instead of 1 and 3.", called)
+	}
+
+	if 1 != len(recovered) || "failed" != recovered[0].Error() {
+		t.Errorf("EmitSync supplied %v to the RecoveryListener instead of the panic.", recovered)
+	}
+}
+
+func TestReplaceListener(t *testing.T) {
+	event := "test"
+	var order []string
+
+	first := func() { order = append(order, "first") }
+	old := func() { order = append(order, "old") }
+	last := func() { order = append(order, "last") }
+
+	emitter := NewSynchronousEmitter().
+		AddListener(event, first).
+		AddListener(event, old).
+		AddListener(event, last).
+		ReplaceListener(event, old, func() { order = append(order, "new") }).
+		Emit(event)
+
+	if expected, actual := "first,new,last", strings.Join(order, ","); expected != actual {
+		t.Errorf("Replaced listener was called in the order %s.", actual)
+	}
+
+	order = nil
+	emitter.
+		ReplaceListener("other", old, old).
+		Emit("other")
+
+	if expected, actual := "old", strings.Join(order, ","); expected != actual {
+		t.Errorf("Replacing an absent listener called %s.", actual)
+	}
+}
+
+func TestReplaceListenerKeepsRegistration(t *testing.T) {
+	event := "test"
+	var invoked []string
+
+	once := func() { invoked = append(invoked, "once") }
+	keyed := func() { invoked = append(invoked, "keyed") }
+	grouped := func() { invoked = append(invoked, "grouped") }
+
+	emitter := NewSynchronousEmitter()
+	group := emitter.BeginGroup()
+
+	emitter.
+		Once(event, once).
+		OnWithKey("keyed", "plugin", keyed).
+		AddListener("grouped", grouped).
+		EndGroup().
+		AddListener("other", func() {}).
+		ReplaceListener(event, once, func() { invoked = append(invoked, "new") }).
+		ReplaceListener("keyed", keyed, func() {}).
+		ReplaceListener("grouped", grouped, func() {}).
+		Emit(event).
+		Emit(event)
+
+	if expected, actual := "new", strings.Join(invoked, ","); expected != actual {
+		t.Errorf("Replacement of a listener added with Once was called as %s.", actual)
+	}
+
+	if emitter.OffByKey("keyed", "plugin"); 0 != emitter.ListenerCount("keyed") {
+		t.Error("Replacement of a keyed listener was not removed by its key.")
+	}
+
+	if emitter.RemoveGroup(group); 0 != emitter.ListenerCount("grouped") || 1 != emitter.ListenerCount("other") {
+		t.Error("RemoveGroup did not remove only the replacement of the grouped listener.")
+	}
+}
+
+func TestReplaceOttoListener(t *testing.T) {
+	event := "test"
+	var invoked string
+
+	vm := otto.New()
+	vm.Set("record", func(call otto.FunctionCall) otto.Value {
+		invoked += call.Argument(0).String()
+		return otto.UndefinedValue()
+	})
+
+	old, _ := vm.Run("(function() { record('old'); })")
+	replacement, _ := vm.Run("(function() { record('new'); })")
+
+	NewEmitterOtto(vm).
+		AddListener(event, old).
+		ReplaceListener(event, old, replacement).
+		Emit(event)
+
+	if "new" != invoked {
+		t.Errorf("Replaced otto listener was called as %s.", invoked)
+	}
+}
+
+func TestEmitContext(t *testing.T) {
+	event := "test"
+	ctx := context.WithValue(context.Background(), tracerKey{}, "value")
+	var supplied interface{}
+	var argument int
+
+	emitter := NewSynchronousEmitter().
+		AddListener(event, func(ctx context.Context, i int) {
+			supplied = ctx.Value(tracerKey{})
+			argument = i
+		}).
+		AddListener(event, func(i int) {
+			if 1 != i {
+				t.Error("Listener without a context was not supplied the argument.")
+			}
+		}).
+		EmitContext(ctx, event, 1)
+
+	if "value" != supplied || 1 != argument {
+		t.Error("Listener was not supplied the context of EmitContext.")
+	}
+
+	emitter.Emit(event, 1)
+
+	if nil != supplied {
+		t.Error("Emit supplied a context other than the background context.")
+	}
+}
+
+func TestEmitErr(t *testing.T) {
+	event := "test"
+	recovered := false
+
+	emitter := NewSynchronousEmitter().
+		RecoverWith(func(event, listener interface{}, err error) { recovered = true }).
+		AddListener(event, func() { panic("first") }).
+		AddListener(event, func() {}).
+		AddListener(event, func() { panic("second") })
+
+	errs := emitter.EmitErr(event)
+
+	if 2 != len(errs) || "first" != errs[0].Error() || "second" != errs[1].Error() {
+		t.Errorf("EmitErr returned %v instead of the panics of the listeners.", errs)
+	}
+
+	if recovered {
+		t.Error("EmitErr supplied the errors to the RecoveryListener.")
+	}
+
+	if errs := emitter.EmitErr("none"); nil != errs {
+		t.Errorf("EmitErr returned %v for an event without failing listeners.", errs)
+	}
+}
+
+func TestEmitJoin(t *testing.T) {
+	event := "test"
+	failed := errors.New("failed")
+
+	emitter := NewEmitter().
+		SetPanicFormatter(func(r interface{}) error { return failed }).
+		AddListener(event, func() { panic("first") }).
+		AddListener(event, func() {}).
+		AddListener(event, func() { panic("second") })
+
+	if err := emitter.EmitJoin("none"); nil != err {
+		t.Errorf("EmitJoin returned %v for an event without failing listeners.", err)
+	}
+
+	err := emitter.EmitJoin(event)
+
+	if nil == err || !strings.HasPrefix(err.Error(), "event `test`") {
+		t.Errorf("EmitJoin returned %v instead of an error naming the event.", err)
+	}
+
+	if !errors.Is(err, failed) {
+		t.Error("Errors joined by EmitJoin could not be matched.")
+	}
+}
+
+func TestOnIf(t *testing.T) {
+	event := "test"
+	var received []int
+
+	NewSynchronousEmitter().
+		OnIf(event, func(arguments ...interface{}) bool { return 0 == arguments[0].(int)%2 }, func(n int) {
+			received = append(received, n)
+		}).
+		Emit(event, 1).
+		Emit(event, 2)
+
+	if 1 != len(received) || 2 != received[0] {
+		t.Errorf("OnIf called the listener with %v instead of only the even number.", received)
+	}
+}
+
+func TestOnIfWithOttoListener(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	listener, _ := vm.Run("var total = 0; (function (n) { total += n; })")
+	predicate, _ := vm.Run("(function (n) { return n > 1; })")
+
+	NewEmitterOtto(vm).
+		OnIf(event, predicate, listener).
+		Emit(event, 1).
+		Emit(event, 2)
+
+	if total, _ := vm.Get("total"); "2" != total.String() {
+		t.Errorf("OnIf called the otto listener for a total of %v instead of 2.", total)
+	}
+}
+
+func TestOnAfter(t *testing.T) {
+	event := "test"
+	var mu sync.Mutex
+	var order []string
+
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		order = append(order, name)
+	}
+
+	emitter := NewEmitter().
+		OnAfter(event, func() { record("b") }, "a").
+		OnWithLabel(event, func() {
+			time.Sleep(10 * time.Millisecond)
+			record("a")
+		}, "a").
+		OnAfter(event, func() { record("c") }, "a").
+		OnAfter(event, func() { record("d") }, "a")
+
+	emitter.Emit(event)
+
+	position := make(map[string]int)
+
+	for i, name := range order {
+		position[name] = i
+	}
+
+	if 4 != len(order) || position["c"] < position["a"] || position["d"] < position["a"] {
+		t.Errorf("OnAfter listeners were called in the order %v.", order)
+	}
+
+	if position["b"] > position["a"] {
+		t.Errorf("Listener added before its label was waited on: %v.", order)
+	}
+
+	if label := emitter.Snapshot()[event].Labels[1]; "a" != label {
+		t.Errorf("OnWithLabel listener was labelled %s.", label)
+	}
+}
+
+func TestEventEmitter(t *testing.T) {
+	vm := otto.New()
+	fn, _ := vm.Run("(function() {})")
+
+	var emitter EventEmitter = NewEmitterOtto(vm)
+
+	emitter.
+		On("go", func() {}).
+		On("go", func() {}).
+		On("otto", fn).
+		On("both", func() {}).
+		On("both", fn)
+
+	if 2 != emitter.ListenerCount("go") || 1 != emitter.ListenerCount("otto") || 2 != emitter.ListenerCount("both") {
+		t.Error("ListenerCount did not count the Go and otto listeners.")
+	}
+
+	names := make(map[interface{}]int)
+
+	for _, name := range emitter.EventNames() {
+		names[name]++
+	}
+
+	if 3 != len(names) || 1 != names["go"] || 1 != names["otto"] || 1 != names["both"] {
+		t.Errorf("EventNames returned %v.", emitter.EventNames())
+	}
+}
+
+func TestListenerReturningError(t *testing.T) {
+	event := "test"
+	failed := errors.New("failed")
+	var recovered error
+
+	emitter := NewSynchronousEmitter().
+		AddListener(event, func() error { return failed }).
+		AddListener(event, func() (int, error) { return 0, nil }).
+		Emit(event)
+
+	emitter.
+		RecoverWith(func(event, listener interface{}, err error) { recovered = err }).
+		Emit(event)
+
+	if failed != recovered {
+		t.Errorf("RecoveryListener was supplied %v instead of the returned error.", recovered)
+	}
+
+	if errs := emitter.EmitErr(event); 1 != len(errs) || failed != errs[0] {
+		t.Errorf("EmitErr returned %v instead of the returned error.", errs)
+	}
+}
+
+type adaptedStruct struct {
+	value int
+}
+
+func TestSetAdaptPointers(t *testing.T) {
+	var fromValue, fromPointer int
+
+	emitter := NewSynchronousEmitter().
+		SetAdaptPointers(true).
+		AddListener("value", func(s *adaptedStruct) { fromValue = s.value }).
+		AddListener("pointer", func(s adaptedStruct) { fromPointer = s.value }).
+		Emit("value", adaptedStruct{value: 1}).
+		Emit("pointer", &adaptedStruct{value: 2})
+
+	if 1 != fromValue {
+		t.Error("Struct value was not adapted to a pointer listener.")
+	}
+
+	if 2 != fromPointer {
+		t.Error("Struct pointer was not adapted to a value listener.")
+	}
+
+	recovered := false
+
+	emitter.
+		SetAdaptPointers(false).
+		RecoverWith(func(event, listener interface{}, err error) { recovered = true }).
+		Emit("value", adaptedStruct{value: 3})
+
+	if !recovered || 3 == fromValue {
+		t.Error("Struct value was adapted with the adaptation disabled.")
+	}
+}
+
+func TestSetShareStructArgs(t *testing.T) {
+	event := "test"
+	var first, second *adaptedStruct
+	var copied adaptedStruct
+
+	NewSynchronousEmitter().
+		SetShareStructArgs(true).
+		AddListener(event, func(s *adaptedStruct) { first = s }).
+		AddListener(event, func(s *adaptedStruct) { second = s }).
+		AddListener(event, func(s adaptedStruct) { copied = s }).
+		Emit(event, adaptedStruct{value: 1})
+
+	if nil == first || first != second || 1 != first.value {
+		t.Error("Pointer listeners did not share a pointer to the struct.")
+	}
+
+	if 1 != copied.value {
+		t.Error("Value listener did not receive the shared struct.")
+	}
+}
+
+func TestHasRecoverer(t *testing.T) {
+	emitter := NewEmitter()
+
+	if emitter.HasRecoverer() {
+		t.Error("New emitter reported a RecoveryListener.")
+	}
+
+	emitter.RecoverWith(func(event, listener interface{}, err error) {})
+
+	if !emitter.HasRecoverer() {
+		t.Error("Emitter did not report its RecoveryListener.")
+	}
+}
+
+func TestEmitPeek(t *testing.T) {
+	event := "test"
+	var persistent, once int
+
+	emitter := NewSynchronousEmitter().
+		AddListener(event, func() { persistent++ }).
+		Once(event, func() { once++ }).
+		EmitPeek(event)
+
+	if 1 != persistent || 0 != once {
+		t.Error("EmitPeek did not skip the Once listener.")
+	}
+
+	emitter.Emit(event)
+
+	if 2 != persistent || 1 != once {
+		t.Error("EmitPeek removed the Once listener.")
+	}
+}
+
+func TestLastEmitted(t *testing.T) {
+	event := "test"
+	emitter := NewEmitter()
+
+	if _, ok := emitter.LastEmitted(event); ok {
+		t.Error("LastEmitted reported an event which was never emitted.")
+	}
+
+	before := time.Now()
+	emitter.Emit(event)
+
+	if emitted, ok := emitter.LastEmitted(event); !ok || emitted.Before(before) {
+		t.Error("LastEmitted did not report the time the event was emitted.")
+	}
+}
+
+func TestOffByKey(t *testing.T) {
+	event := "test"
+	var invoked []string
+
+	vm := otto.New()
+	vm.Set("record", func(call otto.FunctionCall) otto.Value {
+		invoked = append(invoked, call.Argument(0).String())
+		return otto.UndefinedValue()
+	})
+
+	ottoListener, _ := vm.Run("(function () { record('otto'); })")
+
+	NewEmitterOtto(vm).
+		SetSynchronous(true).
+		OnWithKey(event, "removed", func() { invoked = append(invoked, "removed") }).
+		OnWithKey(event, "kept", func() { invoked = append(invoked, "kept") }).
+		OnWithKey(event, "removed", ottoListener).
+		AddListener(event, func() { invoked = append(invoked, "unkeyed") }).
+		OffByKey(event, "removed").
+		OffByKey(event, nil).
+		Emit(event)
+
+	if expected, actual := "kept,unkeyed", strings.Join(invoked, ","); expected != actual {
+		t.Errorf("OffByKey left the listeners %s.", actual)
+	}
+}
+
+func TestWaitForEvent(t *testing.T) {
+	event := "test"
+	emitter := NewEmitter()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		emitter.Emit(event, "fired")
+	}()
+
+	if arguments, ok := emitter.WaitForEvent(event, time.Second); !ok || 1 != len(arguments) || "fired" != arguments[0] {
+		t.Errorf("WaitForEvent returned %v instead of the emitted arguments.", arguments)
+	}
+
+	if _, ok := emitter.WaitForEvent(event, 10*time.Millisecond); ok {
+		t.Error("WaitForEvent returned true without an emit.")
+	}
+
+	if 0 != emitter.ListenerCount(event) {
+		t.Error("WaitForEvent left its listener.")
+	}
+}
+
+func TestWaitForEventContext(t *testing.T) {
+	event := "test"
+	emitter := NewEmitter()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	if arguments, ok, err := emitter.WaitForEventContext(ctx, event); ok || nil != arguments || context.Canceled != err {
+		t.Errorf("WaitForEventContext returned %v, %v and %v after the cancellation.", arguments, ok, err)
+	}
+
+	if 0 != emitter.ListenerCount(event) {
+		t.Error("WaitForEventContext left its listener.")
+	}
+}
+
+func TestWaitForEventContextClosed(t *testing.T) {
+	emitter := NewEmitter()
+	emitter.Close()
+
+	if arguments, ok, err := emitter.WaitForEventContext(context.Background(), "test"); ok || nil != arguments || !errors.Is(err, ErrClosed) {
+		t.Errorf("WaitForEventContext returned %v, %v and %v on a closed Emitter.", arguments, ok, err)
+	}
+}
+
+func TestAwait(t *testing.T) {
+	event := "test"
+	emitter := NewEmitter()
+	future := emitter.Await(event)
+
+	emitter.Emit(event, "first").Emit(event, "second")
+
+	if arguments, err := future.Get(context.Background()); nil != err || 1 != len(arguments) || "first" != arguments[0] {
+		t.Errorf("Get returned %v and %v instead of the arguments of the first emit.", arguments, err)
+	}
+
+	if 0 != emitter.ListenerCount(event) {
+		t.Error("Resolved Future left its listener.")
+	}
+}
+
+func TestAwaitCancelled(t *testing.T) {
+	event := "test"
+	emitter := NewEmitter()
+	future := emitter.Await(event)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if arguments, err := future.Get(ctx); nil != arguments || context.Canceled != err {
+		t.Errorf("Get returned %v and %v after the cancellation.", arguments, err)
+	}
+
+	if 0 != emitter.ListenerCount(event) {
+		t.Error("Cancelled Future left its listener.")
+	}
+
+	emitter.Emit(event)
+
+	if _, err := future.Get(context.Background()); ErrNotAwaiting != err {
+		t.Errorf("Get of a cancelled Future returned %v instead of ErrNotAwaiting.", err)
+	}
+}
+
+func TestSetOttoVMPool(t *testing.T) {
+	event := "test"
+	var arrived sync.WaitGroup
+	var parallel int32
+
+	arrived.Add(2)
+
+	factory := func() *otto.Otto {
+		vm := otto.New()
+		vm.Set("arrive", func(call otto.FunctionCall) otto.Value {
+			arrived.Done()
+
+			done := make(chan struct{})
+
+			go func() {
+				arrived.Wait()
+				close(done)
+			}()
+
+			select {
+			case <-done:
+				atomic.AddInt32(&parallel, 1)
+			case <-time.After(time.Second):
+			}
+
+			return otto.UndefinedValue()
+		})
+		return vm
+	}
+
+	vm := otto.New()
+	first, _ := vm.Run("(function (n) { arrive(n); })")
+	second, _ := vm.Run("(function (n) { arrive(n + 1); })")
+
+	NewEmitterOtto(vm).
+		SetOttoVMPool(2, factory).
+		AddListener(event, first).
+		AddListener(event, second).
+		Emit(event, 1)
+
+	if 2 != parallel {
+		t.Error("Otto listeners were not called in parallel on the pool.")
+	}
+}
+
+func TestEmitReleasesArguments(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	listener, _ := vm.Run("(function (payload) {})")
+
+	emitter := NewEmitterOtto(vm).
+		AddListener(event, func(payload *[1 << 20]byte) {}).
+		AddListener(event, func(payload *[1 << 20]byte) {}).
+		AddListener(event, listener)
+
+	released := make(chan struct{})
+
+	func() {
+		payload := new([1 << 20]byte)
+		runtime.SetFinalizer(payload, func(*[1 << 20]byte) { close(released) })
+
+		emitter.Emit(event, payload)
+	}()
+
+	// A single collection, as sync.Pool keeps its items alive for one.
+	runtime.GC()
+
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Error("Emitter kept a reference to the emitted arguments.")
+	}
+}
+
+func TestSinkTo(t *testing.T) {
+	sunk := make(chan EmittedRecord, 1)
+	emitter := NewEmitter().
+		SinkTo(sunk, false).
+		AddListener("handled", func(int) {}).
+		Emit("handled", 1).
+		Emit("unhandled", 2)
+
+	if record := <-sunk; "handled" != record.Event || 1 != len(record.Args) || 1 != record.Args[0] || record.Time.IsZero() {
+		t.Errorf("SinkTo sent the record %v.", record)
+	}
+
+	if drops := emitter.Stats().SinkDrops; 1 != drops["unhandled"] {
+		t.Errorf("SinkTo counted the drops %v instead of the emit to the full channel.", drops)
+	}
+
+	emitter.Unsink(sunk).Emit("handled", 3)
+
+	select {
+	case record := <-sunk:
+		t.Errorf("Unsink left the channel receiving %v.", record)
+	default:
+	}
+}
+
+func TestErrors(t *testing.T) {
+	event := "test"
+	emitter := NewEmitter()
+	failures := emitter.Errors()
+
+	emitter.AddListener(event, func() { panic("failed") }).Emit(event)
+
+	if failure := <-failures; event != failure.Event || "failed" != failure.Err.Error() {
+		t.Errorf("Errors received %v instead of the recovered panic.", failure)
+	}
+
+	for i := 0; i < DefaultErrorsBuffer+1; i++ {
+		emitter.Emit(event)
+	}
+
+	if drops := emitter.Stats().ErrorDrops; 1 != drops[event] {
+		t.Errorf("Errors counted the drops %v instead of the failure to the full channel.", drops)
+	}
+}
+
+func TestOnAny(t *testing.T) {
+	var seen []string
+
+	observer := func(event interface{}, arguments ...interface{}) {
+		seen = append(seen, fmt.Sprintf("%v %v", event, arguments))
+	}
+
+	emitter := NewSynchronousEmitter().
+		OnAny(observer).
+		AddListener("handled", func(i int) {}).
+		Emit("handled", 1).
+		Emit("unhandled", 2)
+
+	if expected, actual := "handled [1],unhandled [2]", strings.Join(seen, ","); expected != actual {
+		t.Errorf("AnyListener saw %s.", actual)
+	}
+
+	seen = nil
+	emitter.OffAny(observer).Emit("handled", 3)
+
+	if 0 != len(seen) {
+		t.Error("OffAny did not remove the AnyListener.")
+	}
+}
+
+func TestSetTruncateArgs(t *testing.T) {
+	event := "test"
+	var received int
+	var variadic int
+	recovered := false
+
+	emitter := NewSynchronousEmitter().
+		RecoverWith(func(event, listener interface{}, err error) { recovered = true }).
+		AddListener(event, func(i int) { received = i }).
+		AddListener(event, func(arguments ...interface{}) { variadic = len(arguments) }).
+		Emit(event, 1, "extra")
+
+	if !recovered || 0 != received {
+		t.Error("Extra arguments were truncated by default.")
+	}
+
+	recovered = false
+	emitter.
+		SetTruncateArgs(true).
+		Emit(event, 2, "extra")
+
+	if recovered || 2 != received {
+		t.Error("Extra arguments were not truncated.")
+	}
+
+	if 2 != variadic {
+		t.Error("Arguments of a variadic listener were truncated.")
+	}
+}
+
+func TestNew(t *testing.T) {
+	event := "test"
+	var warnings bytes.Buffer
+	recovered := false
+	vm := otto.New()
+
+	emitter := New(
+		WithOttoVM(vm),
+		WithMaxListeners(1),
+		WithRecoverer(func(event, listener interface{}, err error) { recovered = true }),
+		WithSynchronous(),
+		WithWarningWriter(&warnings),
+	)
+
+	if !emitter.HasOttoVM() || 1 != emitter.MaxListeners() {
+		t.Error("New did not apply the options.")
+	}
+
+	emitter.
+		AddListener(event, func() { panic("failed") }).
+		AddListener(event, func() {}).
+		Emit(event)
+
+	if !recovered {
+		t.Error("New did not set the RecoveryListener.")
+	}
+
+	if !strings.Contains(warnings.String(), "maximum number of listeners") {
+		t.Error("New did not set the warning writer.")
+	}
+}
+
+func TestIndexOfListener(t *testing.T) {
+	event := "test"
+	first, second, missing := func() {}, func() {}, func() {}
+	vm := otto.New()
+	ottoListener, _ := vm.Run("(function () {})")
+
+	emitter := NewEmitterOtto(vm).
+		AddListener(event, first).
+		AddListener(event, ottoListener).
+		AddListener(event, second).
+		AddListener(event, second)
+
+	if index := emitter.IndexOfListener(event, second); 1 != index {
+		t.Errorf("IndexOfListener returned %d instead of 1.", index)
+	}
+
+	if index := emitter.IndexOfListener(event, ottoListener); 0 != index {
+		t.Errorf("IndexOfListener returned %d for the otto listener instead of 0.", index)
+	}
+
+	if index := emitter.IndexOfListener(event, missing); -1 != index {
+		t.Errorf("IndexOfListener returned %d for a missing listener instead of -1.", index)
+	}
+}
+
+func TestEventNamesSorted(t *testing.T) {
+	type key struct{ name string }
+
+	emitter := NewEmitter().SetMaxListeners(-1)
+
+	for _, event := range []interface{}{"b", 2, key{"y"}, "a", 10, key{"x"}, true, false} {
+		emitter.AddListener(event, func() {})
+	}
+
+	expected := "false true {x} {y} 2 10 a b"
+
+	if actual := strings.Trim(fmt.Sprint(emitter.EventNames()), "[]"); expected != actual {
+		t.Errorf("EventNames returned %s instead of %s.", actual, expected)
+	}
+}
+
+func TestEventNamesMatching(t *testing.T) {
+	emitter := NewEmitter()
+
+	for _, event := range []interface{}{"db.write", "http.get", 1, "db.read"} {
+		emitter.AddListener(event, func() {})
+	}
+
+	names := emitter.EventNamesMatching(func(event interface{}) bool {
+		name, ok := event.(string)
+		return ok && strings.HasPrefix(name, "db.")
+	})
+
+	if expected, actual := "db.read db.write", strings.Trim(fmt.Sprint(names), "[]"); expected != actual {
+		t.Errorf("EventNamesMatching returned %s instead of %s.", actual, expected)
+	}
+}
+
+func TestValidateListener(t *testing.T) {
+	vm := otto.New()
+	fn, _ := vm.Run("(function () {})")
+	number, _ := vm.Run("1")
+	emitter := NewEmitterOtto(vm)
+
+	if nil != emitter.ValidateListener(func() {}) || nil != emitter.ValidateListener(fn) {
+		t.Error("ValidateListener rejected a valid listener.")
+	}
+
+	if ErrNoneFunction != emitter.ValidateListener(number) || ErrNoneFunction != emitter.ValidateListener(1) {
+		t.Error("ValidateListener accepted an invalid listener.")
+	}
+
+	if 0 != len(emitter.EventNames()) {
+		t.Error("ValidateListener added the listener.")
+	}
+
+	if ErrNoOttoVM != NewEmitter().ValidateListener(fn) {
+		t.Error("ValidateListener accepted an otto listener without an otto VM.")
+	}
+
+	if emitter.Close(); ErrClosed != emitter.ValidateListener(func() {}) {
+		t.Error("ValidateListener accepted a listener of a closed Emitter.")
+	}
+}
+
+func TestEmitBubbling(t *testing.T) {
+	var received []string
+
+	record := func(listener string) func(arguments ...interface{}) {
+		return func(arguments ...interface{}) {
+			received = append(received, fmt.Sprintf("%s %v", listener, arguments))
+		}
+	}
+
+	emitter := NewSynchronousEmitter().
+		AddListener("user", record("user")).
+		AddListener("user.profile", record("profile")).
+		AddListener("user.profile.updated", record("updated")).
+		EmitBubbling("user.profile.updated", 1)
+
+	expected := "updated [1],profile [user.profile.updated 1],user [user.profile.updated 1]"
+
+	if actual := strings.Join(received, ","); expected != actual {
+		t.Errorf("EmitBubbling called %s.", actual)
+	}
+
+	received = nil
+	emitter.Emit("user.profile.updated", 2)
+
+	if expected, actual := "updated [2]", strings.Join(received, ","); expected != actual {
+		t.Errorf("Emit without bubbling called %s.", actual)
+	}
+
+	received = nil
+	emitter.SetBubbling(true).Emit("user.settings", 3)
+
+	if expected, actual := "user [user.settings 3]", strings.Join(received, ","); expected != actual {
+		t.Errorf("Bubbling Emitter called %s.", actual)
+	}
+}
+
+func TestEmitErrContext(t *testing.T) {
+	event := "test"
+	release := make(chan struct{})
+	defer close(release)
+
+	emitter := NewSynchronousEmitter().
+		AddListener(event, func(ctx context.Context) { panic("failed") }).
+		AddListener(event, func(ctx context.Context) { <-release })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	errs, err := emitter.EmitErrContext(ctx, event)
+
+	if context.Canceled != err {
+		t.Errorf("EmitErrContext returned %v instead of the cancellation.", err)
+	}
+
+	if 1 != len(errs) || "failed" != errs[0].Error() {
+		t.Errorf("EmitErrContext returned %v instead of the listener error.", errs)
+	}
+
+	if errs, err := emitter.EmitErrContext(ctx, event); nil != errs || context.Canceled != err {
+		t.Error("EmitErrContext emitted with a cancelled context.")
+	}
+}
+
+func TestRemoveFirstAndLastListener(t *testing.T) {
+	event := "test"
+	var invoked []string
+
+	vm := otto.New()
+	vm.Set("record", func(call otto.FunctionCall) otto.Value {
+		invoked = append(invoked, call.Argument(0).String())
+		return otto.UndefinedValue()
+	})
+
+	ottoListener, _ := vm.Run("(function () { record('otto'); })")
+
+	emitter := NewEmitterOtto(vm).
+		SetSynchronous(true).
+		AddListener(event, func() { invoked = append(invoked, "first") }).
+		AddListener(event, func() { invoked = append(invoked, "second") }).
+		AddListener(event, ottoListener)
+
+	if !emitter.RemoveLastListener(event) {
+		t.Error("RemoveLastListener did not remove the otto listener.")
+	}
+
+	if !emitter.RemoveFirstListener(event) {
+		t.Error("RemoveFirstListener did not remove the first listener.")
+	}
+
+	emitter.Emit(event)
+
+	if expected, actual := "second", strings.Join(invoked, ","); expected != actual {
+		t.Errorf("Remaining listeners were %s.", actual)
+	}
+
+	if emitter.RemoveLastListener("absent") || emitter.RemoveFirstListener("absent") {
+		t.Error("Listener was removed from an absent event.")
+	}
+}
+
+func TestRemoveListenerAddedMoreThanOnce(t *testing.T) {
+	event := "test"
+	invoked := 0
+	listener := func() { invoked++ }
+
+	NewSynchronousEmitter().
+		AddListener(event, listener).
+		AddListener(event, listener).
+		AddListener(event, listener).
+		AddListener(event, func() {}).
+		RemoveListener(event, listener).
+		Emit(event)
+
+	if 0 != invoked {
+		t.Errorf("Listener added three times was still called %d times.", invoked)
+	}
+}
+
+func TestRemoveListenerDuplicatesRegression(t *testing.T) {
+	event := "test"
+	invoked := 0
+	removed := func() { invoked++ }
+	kept := func() {}
+
+	vm := otto.New()
+	ottoRemoved, _ := vm.Run("(function () { throw 'removed'; })")
+	ottoKept, _ := vm.Run("(function () {})")
+
+	// Adjacent and trailing duplicates made the former in-place removal
+	// skip registrations or index out of range.
+	emitter := NewEmitterOtto(vm).
+		SetSynchronous(true).
+		AddListener(event, removed).
+		AddListener(event, removed).
+		AddListener(event, kept).
+		AddListener(event, removed).
+		AddListener(event, ottoRemoved).
+		AddListener(event, ottoRemoved).
+		AddListener(event, ottoKept).
+		AddListener(event, ottoRemoved).
+		RemoveListener(event, removed).
+		RemoveListener(event, ottoRemoved)
+
+	emitter.Emit(event)
+
+	if 0 != invoked {
+		t.Errorf("Removed Go listener was still called %d times.", invoked)
+	}
+
+	if snapshot := emitter.Snapshot()[event]; 1 != len(snapshot.Labels) || 1 != len(snapshot.OttoLabels) {
+		t.Errorf("RemoveListener left %d Go and %d otto listeners.", len(snapshot.Labels), len(snapshot.OttoLabels))
+	}
+}
+
+func TestMute(t *testing.T) {
+	event := "test"
+	invoked := 0
+
+	emitter := NewEmitter().
+		AddListener(event, func() { invoked++ }).
+		Mute(event).
+		Emit(event)
+
+	if 0 != invoked || !emitter.IsMuted(event) {
+		t.Error("Muted event was emitted.")
+	}
+
+	emitter.Unmute(event).Emit(event)
+
+	if 1 != invoked || emitter.IsMuted(event) {
+		t.Error("Unmuted event was not emitted.")
+	}
+}
+
+func TestMuteBuffered(t *testing.T) {
+	event := "test"
+	var received []int
+
+	emitter := NewSynchronousEmitter().
+		AddListener(event, func(i int) { received = append(received, i) }).
+		MuteBuffered(event, 3, DropOldest, true)
+
+	for _, i := range []int{1, 2, 2, 3, 4} {
+		emitter.Emit(event, i)
+	}
+
+	if 0 != len(received) {
+		t.Error("Buffered event was emitted while muted.")
+	}
+
+	emitter.Unmute(event)
+
+	if expected, actual := "[2 3 4]", fmt.Sprint(received); expected != actual {
+		t.Errorf("Unmute replayed %s instead of %s.", actual, expected)
+	}
+
+	received = nil
+	emitter.MuteBuffered(event, 2, DropNewest, false)
+
+	for _, i := range []int{1, 1, 2} {
+		emitter.Emit(event, i)
+	}
+
+	emitter.Unmute(event)
+
+	if expected, actual := "[1 1]", fmt.Sprint(received); expected != actual {
+		t.Errorf("Unmute replayed %s instead of %s.", actual, expected)
+	}
+}
+
+func TestMuteBufferedNegativeCapacity(t *testing.T) {
+	event := "test"
+	invoked := false
+
+	emitter := NewSynchronousEmitter().
+		AddListener(event, func(i int) { invoked = true }).
+		MuteBuffered(event, -1, DropOldest, false).
+		Emit(event, 1).
+		Unmute(event)
+
+	if invoked || 1 != emitter.ListenerCount(event) {
+		t.Error("Emit with a negative buffer capacity was replayed or left the Emitter locked.")
+	}
+}
+
+func TestMuteKeepsOnceListeners(t *testing.T) {
+	event := "test"
+	invoked := 0
+
+	emitter := NewEmitter().
+		Once(event, func(string) { invoked++ }).
+		Mute(event)
+	future := emitter.Await(event)
+
+	emitter.Emit(event, "muted")
+
+	if 0 != invoked || 2 != emitter.ListenerCount(event) {
+		t.Error("Muted emit consumed the Once listener or the Future.")
+	}
+
+	emitter.Unmute(event).Emit(event, "unmuted")
+
+	if 1 != invoked || 0 != emitter.ListenerCount(event) {
+		t.Errorf("Once listener was called %d times after Unmute.", invoked)
+	}
+
+	if arguments, err := future.Get(context.Background()); nil != err || "unmuted" != arguments[0] {
+		t.Errorf("Future resolved with %v and %v instead of the unmuted emit.", arguments, err)
+	}
+}
+
+func TestMuteBufferedKeepsOnceListeners(t *testing.T) {
+	event := "test"
+	var received []int
+
+	emitter := NewSynchronousEmitter().
+		Once(event, func(i int) { received = append(received, i) }).
+		MuteBuffered(event, 2, DropOldest, false)
+	future := emitter.Await(event)
+
+	emitter.Emit(event, 1).Emit(event, 2)
+
+	if 0 != len(received) || 2 != emitter.ListenerCount(event) {
+		t.Error("Buffered emit consumed the Once listener or the Future.")
+	}
+
+	emitter.Unmute(event)
+
+	if expected, actual := "[1]", fmt.Sprint(received); expected != actual {
+		t.Errorf("Replay called the Once listener with %s instead of %s.", actual, expected)
+	}
+
+	if arguments, err := future.Get(context.Background()); nil != err || 1 != arguments[0] {
+		t.Errorf("Future resolved with %v and %v instead of the first replayed emit.", arguments, err)
+	}
+}
+
+func TestCoalesceOnTick(t *testing.T) {
+	event := "test"
+	received := make(chan int, 10)
+
+	emitter := NewEmitter().
+		AddListener(event, func(i int) { received <- i }).
+		CoalesceOnTick(event, 20*time.Millisecond).
+		Emit(event, 1).
+		Emit(event, 2).
+		Emit(event, 3)
+
+	if pending := emitter.PendingCoalesced(event); 3 != pending {
+		t.Errorf("PendingCoalesced returned %d instead of 3.", pending)
+	}
+
+	select {
+	case i := <-received:
+		if 3 != i {
+			t.Errorf("Tick emitted %d instead of the latest emit.", i)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Tick did not emit the coalesced emits.")
+	}
+
+	emitter.Emit(event, 4).Flush(event)
+
+	if i := <-received; 4 != i || 0 != emitter.PendingCoalesced(event) {
+		t.Errorf("Flush emitted %d instead of the held emit.", i)
+	}
+
+	emitter.StopCoalescing(event).Emit(event, 5)
+
+	if i := <-received; 5 != i {
+		t.Errorf("Emit after StopCoalescing received %d.", i)
+	}
+
+	select {
+	case i := <-received:
+		t.Errorf("Coalesced emits were emitted again with %d.", i)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestOttoListenerSources(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	vm.Set("native", func(call otto.FunctionCall) otto.Value { return otto.UndefinedValue() })
+
+	scripted, _ := vm.Run("(function greet(name) { return 'hello ' + name; })")
+	native, _ := vm.Get("native")
+
+	sources := NewEmitterOtto(vm).
+		AddListener(event, scripted).
+		AddListener(event, native).
+		OttoListenerSources(event)
+
+	if 2 != len(sources) || "function greet(name) { return 'hello ' + name; }" != sources[0] || NativeSource != sources[1] {
+		t.Errorf("OttoListenerSources returned %q.", sources)
+	}
+}
+
+func TestOffOttoBySource(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	source := "function (i) { return i; }"
+	first, _ := vm.Run("(" + source + ")")
+	reloaded, _ := vm.Run("(" + source + ")")
+	other, _ := vm.Run("(function () {})")
+
+	emitter := NewEmitterOtto(vm).
+		AddListener(event, first).
+		AddListener(event, other).
+		AddListener(event, reloaded).
+		OffOttoBySource(event, " "+source+"\n")
+
+	if sources := emitter.OttoListenerSources(event); 1 != len(sources) || "function () {}" != sources[0] {
+		t.Errorf("OffOttoBySource left the otto listeners %v.", sources)
+	}
+}
+
+func TestEmitEvent(t *testing.T) {
+	var received Event
+	var arguments []interface{}
+
+	NewEmitter().
+		OnEvent("audit", func(ev Event, args ...interface{}) {
+			received = ev
+			arguments = args
+		}).
+		EmitEvent(Event{Name: "audit", Context: map[string]interface{}{"user": "otto"}}, 1, 2)
+
+	if "audit" != received.Name || "otto" != received.Context["user"] || received.Timestamp.IsZero() {
+		t.Errorf("Listener received the event %v.", received)
+	}
+
+	if 2 != len(arguments) || 1 != arguments[0] || 2 != arguments[1] {
+		t.Errorf("Listener received the arguments %v.", arguments)
+	}
+}
+
+func TestRangeListeners(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	fn, _ := vm.Run("(function () {})")
+
+	emitter := NewEmitterOtto(vm).
+		AddListener(event, func() {}).
+		AddListener(event, func(i int) {}).
+		AddListener(event, fn)
+
+	var kinds []ListenerKind
+
+	emitter.RangeListeners(event, func(kind ListenerKind, listener interface{}) bool {
+		kinds = append(kinds, kind)
+		return true
+	})
+
+	if 3 != len(kinds) || GoListener != kinds[0] || GoListener != kinds[1] || OttoListener != kinds[2] {
+		t.Errorf("RangeListeners iterated the kinds %v.", kinds)
+	}
+
+	visited := 0
+
+	emitter.RangeListeners(event, func(kind ListenerKind, listener interface{}) bool {
+		visited++
+		return false
+	})
+
+	if 1 != visited {
+		t.Errorf("RangeListeners visited %d listeners after being stopped.", visited)
+	}
+}
+
+func TestRecoveryListenerPanics(t *testing.T) {
+	event := "test"
+	var warnings bytes.Buffer
+	called := false
+
+	NewSynchronousEmitter().
+		SetWarningWriter(&warnings).
+		RecoverWith(func(event, listener interface{}, err error) { panic("recoverer failed") }).
+		AddListener(event, func() { panic("failed") }).
+		AddListener(event, func() { called = true }).
+		AddListener(event, "not a function").
+		Emit(event)
+
+	if !called {
+		t.Error("Listener after the panicking RecoveryListener was not called.")
+	}
+
+	if 2 != strings.Count(warnings.String(), "recoverer failed") {
+		t.Errorf("Panics of the RecoveryListener were reported as %q.", warnings.String())
+	}
+}
+
+func TestEmitWithRecover(t *testing.T) {
+	event := "test"
+	var installed, override int
+
+	emitter := NewEmitter().
+		RecoverWith(func(event, listener interface{}, err error) { installed++ }).
+		AddListener(event, func() { panic("failed") }).
+		EmitWithRecover(func(event, listener interface{}, err error) { override++ }, event)
+
+	if 0 != installed || 1 != override {
+		t.Error("EmitWithRecover did not use the supplied RecoveryListener.")
+	}
+
+	emitter.Emit(event)
+
+	if 1 != installed || 1 != override {
+		t.Error("EmitWithRecover replaced the installed RecoveryListener.")
+	}
+}
+
+func TestEmitFirst(t *testing.T) {
+	event := "test"
+	var called []string
+
+	vm := otto.New()
+	fn, _ := vm.Run("(function (name) { return 'hello ' + name; })")
+
+	emitter := NewEmitterOtto(vm).
+		AddListener(event, func(name string) { called = append(called, "none") }).
+		AddListener(event, func(name string) error { return nil }).
+		AddListener(event, func(name string) *string { return nil }).
+		AddListener(event, fn)
+
+	if result, ok := emitter.EmitFirst(event, "otto"); !ok || "hello otto" != result {
+		t.Errorf("EmitFirst returned %v instead of the otto listener's result.", result)
+	}
+
+	emitter.
+		AddListener("answered", func() int { called = append(called, "first"); return 1 }).
+		AddListener("answered", func() int { called = append(called, "second"); return 2 })
+
+	if result, ok := emitter.EmitFirst("answered"); !ok || 1 != result {
+		t.Errorf("EmitFirst returned %v instead of the first result.", result)
+	}
+
+	if expected, actual := "none,first", strings.Join(called, ","); expected != actual {
+		t.Errorf("EmitFirst called %s.", actual)
+	}
+
+	if _, ok := emitter.EmitFirst("absent"); ok {
+		t.Error("EmitFirst found a result without listeners.")
+	}
+}
+
+func TestEmitFirstKeepsOnceListeners(t *testing.T) {
+	event := "test"
+	invoked := false
+
+	emitter := NewEmitter().
+		AddListener(event, func() string { return "answer" })
+
+	future := emitter.Await(event)
+	emitter.Once(event, func() { invoked = true })
+
+	if result, ok := emitter.EmitFirst(event); !ok || "answer" != result {
+		t.Errorf("EmitFirst returned %v instead of the answering listener's result.", result)
+	}
+
+	if invoked || 3 != emitter.ListenerCount(event) {
+		t.Error("EmitFirst consumed the listeners added with Once.")
+	}
+
+	emitter.Emit(event)
+
+	if arguments, err := future.Get(context.Background()); nil != err || 0 != len(arguments) || !invoked {
+		t.Errorf("Once listeners were not called by the next emit, Get returned %v and %v.", arguments, err)
+	}
+}
+
+func TestEmitReduce(t *testing.T) {
+	event := "test"
+	vm := otto.New()
+	listener, _ := vm.Run("(function (n) { return n * 10; })")
+	sum := func(accumulator, result interface{}) interface{} {
+		switch n := result.(type) {
+		case int:
+			return accumulator.(int) + n
+		case float64:
+			return accumulator.(int) + int(n)
+		}
+
+		return accumulator
+	}
+
+	reduced := NewEmitterOtto(vm).
+		AddListener(event, func(n int) int { return n }).
+		AddListener(event, func(n int) (int, error) { return 2 * n, nil }).
+		AddListener(event, func(n int) {}).
+		AddListener(event, func(n int) error { return nil }).
+		AddListener(event, listener).
+		EmitReduce(event, sum, 100, 1)
+
+	if 113 != reduced {
+		t.Errorf("EmitReduce returned %v instead of 113.", reduced)
+	}
+}
+
+func TestMaxListenersCountsOttoListeners(t *testing.T) {
+	event := "test"
+	var warnings bytes.Buffer
+	vm := otto.New()
+
+	emitter := NewEmitterOtto(vm).
+		SetWarningWriter(&warnings).
+		SetMaxListeners(4)
+
+	for i := 0; i < 2; i++ {
+		fn, _ := vm.Run("(function () {})")
+
+		emitter.
+			AddListener(event, func() {}).
+			AddListener(event, fn)
+	}
+
+	if 0 != warnings.Len() {
+		t.Error("Warning was printed before reaching the maximum listeners.")
+	}
+
+	fn, _ := vm.Run("(function () {})")
+	emitter.AddListener(event, fn)
+
+	if !strings.Contains(warnings.String(), "maximum number of listeners of 4") {
+		t.Error("Otto listeners were not counted towards the maximum listeners.")
+	}
+}
+
+func TestReset(t *testing.T) {
+	event := "test"
+	invoked := false
+	vm := otto.New()
+	fn, _ := vm.Run("(function () {})")
+
+	emitter := NewEmitterOtto(vm).
+		SetMaxListeners(3).
+		SetEventMaxListeners(event, 5).
+		RecoverWith(func(event, listener interface{}, err error) {}).
+		OnAny(func(event interface{}, arguments ...interface{}) { invoked = true }).
+		AddListener(event, func() { invoked = true }).
+		AddListener(event, fn).
+		Reset().
+		Emit(event)
+
+	if invoked || 0 != emitter.ListenerCount(event) {
+		t.Error("Reset did not remove the listeners.")
+	}
+
+	if 3 != emitter.MaxListeners() || 5 != emitter.EventMaxListeners(event) || !emitter.HasRecoverer() || !emitter.HasOttoVM() {
+		t.Error("Reset did not keep the configuration.")
+	}
+
+	if _, ok := emitter.Reset().LastEmitted(event); ok {
+		t.Error("Reset kept the time of the last emit.")
+	}
+}
+
+func TestEmitAsyncErr(t *testing.T) {
+	event := "test"
+	failure := errors.New("failed")
+
+	emitter := NewEmitter().
+		AddListener(event, func() error { return failure }).
+		AddListener(event, func() { panic("panicked") }).
+		AddListener(event, func() error { return nil })
+
+	var errs []error
+
+	for err := range emitter.EmitAsyncErr(event) {
+		errs = append(errs, err)
+	}
+
+	if 2 != len(errs) {
+		t.Errorf("EmitAsyncErr sent %v instead of the errors of both failing listeners.", errs)
+	}
+
+	for err := range emitter.EmitAsyncErr("unhandled") {
+		t.Errorf("EmitAsyncErr sent %v for an event without listeners.", err)
+	}
+}
+
+func TestEmitAsyncErrUndrained(t *testing.T) {
+	event := "test"
+
+	emitter := NewEmitter().
+		AddListener(event, func() error { return errors.New("failed") }).
+		AddListener(event, func() { panic("panicked") })
+
+	errs := emitter.EmitAsyncErr(event)
+
+	for deadline := time.Now().Add(time.Second); len(errs) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("EmitAsyncErr buffered %d errors instead of 2.", len(errs))
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	<-errs
+	<-errs
+
+	select {
+	case _, open := <-errs:
+		if open {
+			t.Error("EmitAsyncErr sent more errors than its listeners failed with.")
+		}
+	case <-time.After(time.Second):
+		t.Error("EmitAsyncErr go routine blocked on errors left unreceived.")
+	}
+}
+
+func TestEmitNotify(t *testing.T) {
+	event := "test"
+	release := make(chan struct{})
+
+	emitter := NewEmitter().
+		AddListener(event, func() { <-release })
+
+	done := emitter.EmitNotify(event)
+
+	select {
+	case <-done:
+		t.Error("EmitNotify channel closed before the listener returned.")
+	default:
+	}
+
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("EmitNotify channel was not closed after the listener returned.")
+	}
+}
+
+func TestEmitNotifyWaitIdle(t *testing.T) {
+	event := "test"
+	var invoked int32
+
+	emitter := NewEmitter().
+		AddListener(event, func() { atomic.StoreInt32(&invoked, 1) })
+
+	emitter.EmitNotify(event)
+	emitter.WaitIdle()
+
+	if 1 != atomic.LoadInt32(&invoked) {
+		t.Error("WaitIdle returned before the listener of EmitNotify was called.")
+	}
+}
+
+type tracerKey struct{}
+
+// recordingTracer records the spans started and finished by an Emitter.
+type recordingTracer struct {
+	sync.Mutex
+	spans []string
+}
+
+func (tracer *recordingTracer) record(span string) {
+	tracer.Lock()
+	defer tracer.Unlock()
+
+	tracer.spans = append(tracer.spans, span)
+}
+
+func (tracer *recordingTracer) StartEmit(ctx context.Context, event interface{}) (context.Context, func()) {
+	tracer.record("emit")
+	return context.WithValue(ctx, tracerKey{}, event), func() { tracer.record("end emit") }
+}
+
+func (tracer *recordingTracer) StartListener(ctx context.Context, event interface{}, label string) func() {
+	if event != ctx.Value(tracerKey{}) {
+		tracer.record("orphan listener")
+	}
+
+	tracer.record("listener")
+	return func() { tracer.record("end listener") }
+}
+
+func TestSetTracer(t *testing.T) {
+	event := "test"
+	tracer := &recordingTracer{}
+
+	emitter := NewSynchronousEmitter().
+		SetTracer(tracer).
+		AddListener(event, func() {}).
+		Emit(event).
+		Emit("unhandled")
+
+	expected := "emit,listener,end listener,end emit"
+
+	if spans := strings.Join(tracer.spans, ","); expected != spans {
+		t.Errorf("Tracer recorded %s instead of %s.", spans, expected)
+	}
+
+	tracer.spans = nil
+	emitter.SetTracer(nil).Emit(event)
+
+	if 0 != len(tracer.spans) {
+		t.Error("Removed tracer was still called.")
+	}
+}
+
+func TestSetInvoker(t *testing.T) {
+	event := "test"
+	var calls []string
+	var recovered []error
+
+	vm := otto.New()
+	vm.Set("record", func(call otto.FunctionCall) otto.Value {
+		calls = append(calls, "otto")
+		return otto.UndefinedValue()
+	})
+	ottoListener, _ := vm.Run("(function () { record(); })")
+
+	NewEmitterOtto(vm).
+		SetSynchronous(true).
+		RecoverWith(func(event, listener interface{}, err error) { recovered = append(recovered, err) }).
+		SetInvoker(func(next func(), event interface{}, label string) {
+			calls = append(calls, "before")
+			defer func() { calls = append(calls, "after") }()
+			next()
+		}).
+		AddListener(event, func() { calls = append(calls, "go") }).
+		AddListener(event, func() { panic("failed") }).
+		AddListener(event, ottoListener).
+		Emit(event)
+
+	if expected, actual := "before,go,after,before,after,before,otto,after", strings.Join(calls, ","); expected != actual {
+		t.Errorf("Invoker wrapped the listener calls as %s.", actual)
+	}
+
+	if 1 != len(recovered) {
+		t.Errorf("Panic raised through the Invoker was supplied as %v.", recovered)
+	}
+}
+
+// recordingMetrics records the timings reported by an Emitter.
+type recordingMetrics struct {
+	sync.Mutex
+	waits     []time.Duration
+	durations []time.Duration
+}
+
+func (metrics *recordingMetrics) QueueWait(event interface{}, wait time.Duration) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	metrics.waits = append(metrics.waits, wait)
+}
+
+func (metrics *recordingMetrics) ListenerDuration(event interface{}, label string, duration time.Duration) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	metrics.durations = append(metrics.durations, duration)
+}
+
+func TestSetMetrics(t *testing.T) {
+	event := "test"
+	metrics := &recordingMetrics{}
+
+	emitter := NewSynchronousEmitter().
+		SetMetrics(metrics).
+		AddListener(event, func() { time.Sleep(10 * time.Millisecond) }).
+		Emit(event)
+
+	if 1 != len(metrics.durations) || 10*time.Millisecond > metrics.durations[0] || 0 != len(metrics.waits) {
+		t.Errorf("Metrics recorded the durations %v and waits %v of an immediate emit.", metrics.durations, metrics.waits)
+	}
+
+	emitter.MuteBuffered(event, 1, DropOldest, false).Emit(event)
+	time.Sleep(20 * time.Millisecond)
+	emitter.Unmute(event)
+
+	if 1 != len(metrics.waits) || 20*time.Millisecond > metrics.waits[0] {
+		t.Errorf("Metrics recorded the waits %v instead of the time buffered.", metrics.waits)
+	}
+}
+
+func BenchmarkEmitSingleListener(b *testing.B) {
+	event := "test"
+	emitter := NewEmitter().
+		AddListener(event, func(i int) {})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		emitter.Emit(event, i)
+	}
+}
+
+func BenchmarkEmitMultipleListeners(b *testing.B) {
+	event := "test"
+	emitter := NewEmitter().
+		AddListener(event, func(i, j int) {}).
+		AddListener(event, func(i, j int) {})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		emitter.Emit(event, i, i)
+	}
+}
+
+func BenchmarkEmitRawListener(b *testing.B) {
+	event := "test"
+	emitter := NewEmitter().
+		OnRaw(event, func(arguments ...interface{}) {})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		emitter.Emit(event, i)
+	}
+}
+
+// Payload large enough for its copies to dominate the cost of an emit.
+type largePayload struct {
+	data [4096]byte
+}
+
+func BenchmarkEmitLargeStruct(b *testing.B) {
+	benchmarkEmitLargeStruct(b, NewEmitter().SetAdaptPointers(true))
+}
+
+func BenchmarkEmitLargeStructShared(b *testing.B) {
+	benchmarkEmitLargeStruct(b, NewEmitter().SetShareStructArgs(true))
+}
+
+func benchmarkEmitLargeStruct(b *testing.B, emitter *Emitter) {
+	event := "test"
+
+	for i := 0; i < 8; i++ {
+		emitter.AddListener(event, func(payload *largePayload) {})
+	}
+
+	payload := largePayload{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		emitter.Emit(event, payload)
+	}
+}
+
+func BenchmarkEmitOttoListener(b *testing.B) {
+	benchmarkEmitOttoListener(b, 0, "ready", 200)
+}
+
+func BenchmarkEmitOttoListenerCached(b *testing.B) {
+	benchmarkEmitOttoListener(b, 16, "ready", 200)
+}
+
+// ottoStatus is a plain struct argument whose otto Value can be cached.
+type ottoStatus struct {
+	Name  string
+	Code  int
+	Tags  [8]string
+	Ready bool
+}
+
+func BenchmarkEmitOttoListenerStruct(b *testing.B) {
+	benchmarkEmitOttoListener(b, 0, ottoStatus{Name: "ready", Code: 200}, 200)
+}
+
+func BenchmarkEmitOttoListenerStructCached(b *testing.B) {
+	benchmarkEmitOttoListener(b, 16, ottoStatus{Name: "ready", Code: 200}, 200)
+}
+
+func benchmarkEmitOttoListener(b *testing.B, cacheSize int, arguments ...interface{}) {
+	event := "test"
+	vm := otto.New()
+	listener, _ := vm.Run("(function (status, code) {})")
+	emitter := NewEmitterOtto(vm).
+		SetOttoValueCache(cacheSize).
+		AddListener(event, listener)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		emitter.Emit(event, arguments...)
+	}
+}
@@ -0,0 +1,59 @@
+package emission
+
+import (
+	"errors"
+	"sync"
+)
+
+// Error presented when EmitGlobal names an Emitter which is not registered.
+var ErrNotRegistered = errors.New("No Emitter is registered with the name.")
+
+// Registry of Emitters by name shared by the whole program, letting modules
+// which share no Emitter reference emit to each other's events.
+var registry = struct {
+	sync.RWMutex
+	emitters map[string]*Emitter
+}{emitters: make(map[string]*Emitter)}
+
+// Register adds the Emitter to the package registry under the name,
+// replacing the Emitter registered with that name before if any. Passing a
+// nil Emitter removes the name from the registry.
+func Register(name string, emitter *Emitter) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if nil == emitter {
+		delete(registry.emitters, name)
+		return
+	}
+
+	registry.emitters[name] = emitter
+}
+
+// Unregister removes the Emitter registered with the name, if any.
+func Unregister(name string) {
+	Register(name, nil)
+}
+
+// Lookup returns the Emitter registered with the name and whether there is
+// one.
+func Lookup(name string) (*Emitter, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	emitter, ok := registry.emitters[name]
+	return emitter, ok
+}
+
+// EmitGlobal emits the event with the arguments, like Emit, on the Emitter
+// registered with the name, returning ErrNotRegistered if there is none.
+func EmitGlobal(name string, event interface{}, arguments ...interface{}) error {
+	emitter, ok := Lookup(name)
+
+	if !ok {
+		return ErrNotRegistered
+	}
+
+	emitter.Emit(event, arguments...)
+	return nil
+}
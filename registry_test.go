@@ -0,0 +1,24 @@
+package emission
+
+import (
+	"testing"
+)
+
+func TestEmitGlobal(t *testing.T) {
+	event := "test"
+	invoked := false
+
+	Register("registry-test", NewEmitter().
+		AddListener(event, func() { invoked = true }))
+	defer Unregister("registry-test")
+
+	if err := EmitGlobal("registry-test", event); nil != err || !invoked {
+		t.Error("EmitGlobal did not emit on the registered emitter.")
+	}
+
+	Unregister("registry-test")
+
+	if err := EmitGlobal("registry-test", event); ErrNotRegistered != err {
+		t.Error("EmitGlobal emitted on an unregistered emitter.")
+	}
+}
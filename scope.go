@@ -0,0 +1,82 @@
+package emission
+
+// ScopedEmitter is a view of an Emitter whose events are named relative to a
+// prefix, see Namespace.
+type ScopedEmitter struct {
+	emitter *Emitter
+	prefix  string
+}
+
+// Namespace returns a view of the Emitter prepending the prefix to the name
+// of every event it adds listeners to, removes them from or emits, so a
+// module can use short event names without colliding with other modules.
+// The prefix is prepended as is, a separator such as "db." included. The
+// view shares the Emitter's listeners and configuration: listeners added
+// through it are listeners of the Emitter under the full event name, which
+// can still be emitted directly or through other views.
+func (emitter *Emitter) Namespace(prefix string) *ScopedEmitter {
+	return &ScopedEmitter{emitter: emitter, prefix: prefix}
+}
+
+// Namespace returns a view nested within the ScopedEmitter, whose prefix is
+// appended to the ScopedEmitter's.
+func (scoped *ScopedEmitter) Namespace(prefix string) *ScopedEmitter {
+	return scoped.emitter.Namespace(scoped.prefix + prefix)
+}
+
+// Emitter returns the Emitter the ScopedEmitter is a view of.
+func (scoped *ScopedEmitter) Emitter() *Emitter {
+	return scoped.emitter
+}
+
+// Prefix returns the prefix of the ScopedEmitter's event names.
+func (scoped *ScopedEmitter) Prefix() string {
+	return scoped.prefix
+}
+
+// Event returns the full name of the event within the Emitter.
+func (scoped *ScopedEmitter) Event(event string) string {
+	return scoped.prefix + event
+}
+
+// AddListener adds the listener to the event of the Emitter named by the
+// prefix and the event, see Emitter.AddListener.
+func (scoped *ScopedEmitter) AddListener(event string, listener interface{}) *ScopedEmitter {
+	scoped.emitter.AddListener(scoped.Event(event), listener)
+	return scoped
+}
+
+// On is an alias for AddListener.
+func (scoped *ScopedEmitter) On(event string, listener interface{}) *ScopedEmitter {
+	return scoped.AddListener(event, listener)
+}
+
+// Once adds the listener to the prefixed event for a single emit, see
+// Emitter.Once.
+func (scoped *ScopedEmitter) Once(event string, listener interface{}) *ScopedEmitter {
+	scoped.emitter.Once(scoped.Event(event), listener)
+	return scoped
+}
+
+// RemoveListener removes the listener from the prefixed event, see
+// Emitter.RemoveListener.
+func (scoped *ScopedEmitter) RemoveListener(event string, listener interface{}) *ScopedEmitter {
+	scoped.emitter.RemoveListener(scoped.Event(event), listener)
+	return scoped
+}
+
+// Off is an alias for RemoveListener.
+func (scoped *ScopedEmitter) Off(event string, listener interface{}) *ScopedEmitter {
+	return scoped.RemoveListener(event, listener)
+}
+
+// Emit emits the prefixed event with the arguments, see Emitter.Emit.
+func (scoped *ScopedEmitter) Emit(event string, arguments ...interface{}) *ScopedEmitter {
+	scoped.emitter.Emit(scoped.Event(event), arguments...)
+	return scoped
+}
+
+// ListenerCount returns the number of listeners of the prefixed event.
+func (scoped *ScopedEmitter) ListenerCount(event string) int {
+	return scoped.emitter.ListenerCount(scoped.Event(event))
+}
@@ -0,0 +1,27 @@
+package emission
+
+import (
+	"testing"
+)
+
+func TestNamespace(t *testing.T) {
+	var received []string
+
+	emitter := NewSynchronousEmitter()
+	db := emitter.Namespace("db.")
+
+	db.On("query", func(query string) { received = append(received, "db "+query) })
+	emitter.On("query", func(query string) { received = append(received, "root "+query) })
+
+	db.Emit("query", "a")
+	emitter.Emit("db.query", "b")
+	db.Namespace("pool.").Emit("query", "c")
+
+	if 2 != len(received) || "db a" != received[0] || "db b" != received[1] {
+		t.Errorf("Scoped emits reached %v instead of the prefixed event only.", received)
+	}
+
+	if 1 != emitter.ListenerCount("db.query") || "db.pool.query" != db.Namespace("pool.").Event("query") {
+		t.Error("Scoped listener was not added to the Emitter under its full name.")
+	}
+}
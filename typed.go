@@ -0,0 +1,21 @@
+package emission
+
+import (
+	"reflect"
+)
+
+// OnTyped adds the listener of the event's single payload of type T, so the
+// listener's signature is checked by the compiler against the payloads
+// emitted with EmitTyped. The listener is added as by AddListener and can be
+// removed with RemoveListener.
+func OnTyped[T any](emitter *Emitter, event interface{}, listener func(T)) *Emitter {
+	return emitter.AddListener(event, listener)
+}
+
+// EmitTyped emits the event with the payload of type T as its only argument,
+// see OnTyped. Listeners taking an interface type receive the payload as the
+// interface, a nil one included, which Emit cannot pass to them as it only
+// sees the payload's dynamic value.
+func EmitTyped[T any](emitter *Emitter, event interface{}, payload T) *Emitter {
+	return emitter.EmitValues(event, []reflect.Value{reflect.ValueOf(&payload).Elem()})
+}
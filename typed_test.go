@@ -0,0 +1,32 @@
+package emission
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEmitTypedStruct(t *testing.T) {
+	type user struct{ name string }
+	var received user
+
+	emitter := NewEmitter()
+	OnTyped(emitter, "login", func(u user) { received = u })
+	EmitTyped(emitter, "login", user{"otto"})
+
+	if "otto" != received.name {
+		t.Errorf("Typed listener received %v instead of the payload.", received)
+	}
+}
+
+func TestEmitTypedInterface(t *testing.T) {
+	var received []error
+
+	emitter := NewSynchronousEmitter()
+	OnTyped(emitter, "failed", func(err error) { received = append(received, err) })
+	EmitTyped(emitter, "failed", errors.New("failed"))
+	EmitTyped[error](emitter, "failed", nil)
+
+	if 2 != len(received) || "failed" != received[0].Error() || nil != received[1] {
+		t.Errorf("Typed listener received %v instead of the payloads.", received)
+	}
+}